@@ -16,14 +16,16 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/rpc"
-	"strconv"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	linter "github.com/google/gerrit-linter"
@@ -34,7 +36,44 @@ import (
 type gerritChecker struct {
 	server *gerrit.Server
 
-	todo chan *gerrit.PendingChecksInfo
+	// source provides change contents. It defaults to server.
+	source gerrit.ChangeSource
+
+	// modePolicy flags source files that become executable.
+	modePolicy bool
+
+	// sinks holds the result sinks per repository. The "*" entry
+	// applies to repositories without their own entry.
+	sinks map[string][]resultSink
+
+	// sources produce the patchsets to check.
+	sources []workSource
+
+	// languages are the languages checked for patchsets from
+	// sources other than the checks plugin. Empty means all
+	// supported languages.
+	languages []string
+
+	// pool limits the checks that run concurrently.
+	pool *workerPool
+
+	// queue holds the patchsets waiting to be checked.
+	queue *workQueue
+
+	// registered caches the checkers registered with the checks
+	// plugin.
+	registered checkerCache
+}
+
+// checkerCacheTTL is how long the list of registered checkers is
+// used before it is fetched again.
+const checkerCacheTTL = time.Minute
+
+// checkerCache holds the list of our checkers.
+type checkerCache struct {
+	mu       sync.Mutex
+	fetched  time.Time
+	checkers []*gerrit.CheckerInfo
 }
 
 // checkerScheme is the scheme by which we are registered in the Gerrit server.
@@ -42,13 +81,12 @@ const checkerScheme = "fmt"
 
 // ListCheckers returns all the checkers for our scheme.
 func (gc *gerritChecker) ListCheckers() ([]*gerrit.CheckerInfo, error) {
-	c, err := gc.server.GetPath("a/plugins/checks/checkers/")
-	if err != nil {
-		log.Fatalf("ListCheckers: %v", err)
-	}
+	return gc.listCheckers(context.Background())
+}
 
-	var out []*gerrit.CheckerInfo
-	if err := gerrit.Unmarshal(c, &out); err != nil {
+func (gc *gerritChecker) listCheckers(ctx context.Context) ([]*gerrit.CheckerInfo, error) {
+	out, err := gc.server.ListCheckers(ctx)
+	if err != nil {
 		return nil, err
 	}
 
@@ -69,10 +107,7 @@ func (gc *gerritChecker) ListCheckers() ([]*gerrit.CheckerInfo, error) {
 // PostChecker creates or changes a checker. It sets up a checker on
 // the given repo, for the given language.
 func (gc *gerritChecker) PostChecker(repo, language string, update bool) (*gerrit.CheckerInfo, error) {
-	hash := sha1.New()
-	hash.Write([]byte(repo))
-
-	uuid := fmt.Sprintf("%s:%s-%x", checkerScheme, language, hash.Sum(nil))
+	uuid := checkerUUID(repo, language)
 	in := gerrit.CheckerInput{
 		UUID:        uuid,
 		Name:        language + " formatting",
@@ -82,26 +117,143 @@ func (gc *gerritChecker) PostChecker(repo, language string, update bool) (*gerri
 		Query:       linter.Formatters[language].Query,
 	}
 
-	body, err := json.Marshal(&in)
+	if update {
+		return gc.server.UpdateChecker(context.Background(), uuid, &in)
+	}
+	return gc.server.CreateChecker(context.Background(), &in)
+}
+
+// checkerUUID returns the UUID of the checker for a repo and language.
+func checkerUUID(repo, language string) string {
+	hash := sha1.New()
+	hash.Write([]byte(repo))
+	return fmt.Sprintf("%s:%s-%x", checkerScheme, language, hash.Sum(nil))
+}
+
+// registeredCheckers returns our checkers on the checks plugin,
+// fetching them at most once per checkerCacheTTL.
+func (gc *gerritChecker) registeredCheckers(ctx context.Context) ([]*gerrit.CheckerInfo, error) {
+	c := &gc.registered
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.checkers != nil && time.Since(c.fetched) < checkerCacheTTL {
+		return c.checkers, nil
+	}
+	checkers, err := gc.listCheckers(ctx)
 	if err != nil {
 		return nil, err
 	}
+	c.checkers, c.fetched = checkers, time.Now()
+	return checkers, nil
+}
 
-	path := "a/plugins/checks/checkers/"
-	if update {
-		path += uuid
+// usesChecksPlugin returns whether the checker works with the checks
+// plugin, to get pending checks or to post results.
+func (gc *gerritChecker) usesChecksPlugin() bool {
+	for _, s := range gc.sources {
+		if _, ok := s.(*pendingSource); ok {
+			return true
+		}
+	}
+	for _, sinks := range gc.sinks {
+		for _, s := range sinks {
+			if _, ok := s.(*checksSink); ok {
+				return true
+			}
+		}
 	}
-	content, err := gc.server.PostPath(path, "application/json", body)
+	return false
+}
+
+// wantLanguage returns whether checks in a language should run for
+// sources other than the checks plugin.
+func (gc *gerritChecker) wantLanguage(lang string) bool {
+	if !linter.IsSupported(lang) {
+		return false
+	}
+	if len(gc.languages) == 0 {
+		return true
+	}
+	for _, l := range gc.languages {
+		if l == lang {
+			return true
+		}
+	}
+	return false
+}
+
+// checkersFor returns the UUIDs of the checkers that apply to a
+// repository, for sources that don't name checkers themselves. With
+// the checks plugin, these are the enabled checkers registered for the
+// repository. Without it, there is one for each language.
+func (gc *gerritChecker) checkersFor(ctx context.Context, repo string) ([]string, error) {
+	var uuids []string
+	if !gc.usesChecksPlugin() {
+		langs := gc.languages
+		if len(langs) == 0 {
+			langs = linter.SupportedLanguages()
+		}
+		for _, l := range langs {
+			uuids = append(uuids, checkerUUID(repo, l))
+		}
+		return uuids, nil
+	}
+
+	checkers, err := gc.registeredCheckers(ctx)
 	if err != nil {
 		return nil, err
 	}
+	for _, c := range checkers {
+		if c.Repository != repo || c.Status != "ENABLED" {
+			continue
+		}
+		if lang, _ := checkerLanguage(c.UUID); gc.wantLanguage(lang) {
+			uuids = append(uuids, c.UUID)
+		}
+	}
+	sort.Strings(uuids)
+	return uuids, nil
+}
 
-	out := gerrit.CheckerInfo{}
-	if err := gerrit.Unmarshal(content, &out); err != nil {
-		return nil, err
+// errNoCheckers is returned by pendingFor if no checkers apply to a
+// repository.
+var errNoCheckers = errors.New("no checkers for repository")
+
+// pendingFor returns the checks to run on a patchset, for sources
+// other than the checks plugin. If uuids is empty, the checkers of the
+// repository run. With the checks plugin, checks that already finished
+// are left out, unless rerun is set.
+func (gc *gerritChecker) pendingFor(ctx context.Context, ps *gerrit.CheckablePatchSetInfo, uuids []string, rerun bool) (*gerrit.PendingChecksInfo, error) {
+	if len(uuids) == 0 {
+		var err error
+		if uuids, err = gc.checkersFor(ctx, ps.Repository); err != nil {
+			return nil, err
+		}
+	}
+	if len(uuids) == 0 {
+		return nil, errNoCheckers
+	}
+	pc := pendingInfo(ps, uuids)
+	if rerun || !gc.usesChecksPlugin() {
+		return pc, nil
 	}
 
-	return &out, nil
+	checks, err := gc.server.ListChecks(ctx, sourceChangeID(ps), ps.PatchSetID, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range checks {
+		p, ok := pc.PendingChecks[c.CheckerUUID]
+		if !ok {
+			continue
+		}
+		if c.State.IsPending() {
+			p.State = c.State
+		} else {
+			delete(pc.PendingChecks, c.CheckerUUID)
+		}
+	}
+	return pc, nil
 }
 
 // checkerLanguage extracts the language to check for from a checker UUID.
@@ -114,35 +266,92 @@ func checkerLanguage(uuid string) (string, bool) {
 	return fields[0], true
 }
 
-// NewGerritChecker creates a server that periodically checks a gerrit
-// server for pending checks.
+// NewGerritChecker creates a server that checks a gerrit server for
+// pending checks. By default, it polls the checks plugin.
 func NewGerritChecker(server *gerrit.Server) (*gerritChecker, error) {
 	gc := &gerritChecker{
 		server: server,
-		todo:   make(chan *gerrit.PendingChecksInfo, 5),
+		source: server,
+		queue:  newWorkQueue(100),
+		pool:   newWorkerPool(runtime.NumCPU(), nil, nil),
+		sinks: map[string][]resultSink{
+			"*": {&checksSink{server: server}},
+		},
+		sources: []workSource{
+			&pendingSource{server: server, interval: 10 * time.Second},
+		},
 	}
 
-	go gc.pendingLoop()
 	return gc, nil
 }
 
+// sinksFor returns the result sinks for a repository.
+func (gc *gerritChecker) sinksFor(repo string) []resultSink {
+	if s, ok := gc.sinks[repo]; ok {
+		return s
+	}
+	return gc.sinks["*"]
+}
+
 // errIrrelevant is a marker error value used for checks that don't apply for a change.
 var errIrrelevant = errors.New("irrelevant")
 
-// checkChange checks a (change, patchset) for correct formatting in the given language. It returns
-// a list of complaints, or the errIrrelevant error if there is nothing to do.
-func (c *gerritChecker) checkChange(changeID string, psID int, language string) ([]string, error) {
-	ch, err := c.server.GetChange(changeID, strconv.Itoa(psID))
+// checkChange checks a patchset for correct formatting in the given language. It returns
+// the files with complaints, or the errIrrelevant error if there is nothing to do. Files that
+// were not checked are returned in skipped, along with the reason.
+func (c *gerritChecker) checkChange(ctx context.Context, snap *snapshot, language string) (bad []fileResult, skipped []string, err error) {
+	cfg := linter.Formatters[language]
+	if cfg == nil {
+		return nil, nil, fmt.Errorf("language %q not configured", language)
+	}
+	ch, err := snap.Change(ctx)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+
+	var names []string
+	for n := range ch.Files {
+		if cfg.Regex.MatchString(n) {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+
+	var attrs *linter.GitAttributes
+	if len(names) > 0 && language != "commitmsg" {
+		attrs, err = snap.GitAttributes(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// modeBad indexes the files in bad that failed the mode policy,
+	// so a formatting complaint can be added to the same entry.
+	modeBad := map[string]int{}
 	req := linter.FormatRequest{}
-	for n, f := range ch.Files {
-		cfg := linter.Formatters[language]
-		if cfg == nil {
-			return nil, fmt.Errorf("language %q not configured", language)
+	for _, n := range names {
+		f := ch.Files[n]
+		if f.Status == "D" {
+			continue
 		}
-		if !cfg.Regex.MatchString(n) {
+		switch t := f.Type(); t {
+		case gerrit.FileRegular:
+		case gerrit.FileExecutable:
+			if c.modePolicy && f.OldType() != gerrit.FileExecutable {
+				modeBad[n] = len(bad)
+				bad = append(bad, fileResult{
+					Name:     n,
+					Message:  "executable bit set",
+					Original: f.Content,
+				})
+			}
+		default:
+			skipped = append(skipped, n+": "+t.String())
+			continue
+		}
+		if attrs != nil && (attrs.IsGenerated(n) ||
+			linter.IsGeneratedContent(f.Content, linter.GeneratedMarkers)) {
+			skipped = append(skipped, n+": generated")
 			continue
 		}
 
@@ -154,153 +363,209 @@ func (c *gerritChecker) checkChange(changeID string, psID int, language string)
 			})
 	}
 	if len(req.Files) == 0 {
-		return nil, errIrrelevant
+		if len(bad) > 0 {
+			return bad, skipped, nil
+		}
+		return nil, skipped, errIrrelevant
 	}
 
 	rep := linter.FormatReply{}
 	if err := linter.Format(&req, &rep); err != nil {
 		_, ok := err.(rpc.ServerError)
 		if ok {
-			return nil, fmt.Errorf("server returned: %s", err)
+			return nil, nil, fmt.Errorf("server returned: %s", err)
 		}
-		return nil, err
+		return nil, nil, err
 	}
 
-	var msgs []string
 	for _, f := range rep.Files {
 		orig := ch.Files[f.Name]
 		if orig == nil {
-			return nil, fmt.Errorf("result had unknown file %q", f.Name)
+			return nil, nil, fmt.Errorf("result had unknown file %q", f.Name)
 		}
 		if !bytes.Equal(f.Content, orig.Content) {
 			msg := f.Message
 			if msg == "" {
 				msg = "found a difference"
 			}
-			msgs = append(msgs, fmt.Sprintf("%s: %s", f.Name, msg))
+			if i, ok := modeBad[f.Name]; ok {
+				bad[i].Message += "; " + msg
+				bad[i].Formatted = f.Content
+				log.Printf("file %s: %s", f.Name, f.Message)
+				continue
+			}
+			bad = append(bad, fileResult{
+				Name:      f.Name,
+				Message:   msg,
+				Original:  orig.Content,
+				Formatted: f.Content,
+			})
 			log.Printf("file %s: %s", f.Name, f.Message)
 		} else {
 			log.Printf("file %s: OK", f.Name)
 		}
 	}
 
-	return msgs, nil
+	return bad, skipped, nil
 }
 
-// pendingLoop periodically contacts gerrit to find new checks to
-// execute. It should be executed in a goroutine.
-func (c *gerritChecker) pendingLoop() {
-	for {
-		// TODO: real rate limiting.
-		time.Sleep(10 * time.Second)
+// Serve starts the work sources, and runs the serve loop, executing
+// formatters for checks that need it. Patchsets are admitted up to
+// four times the number of workers, so checks waiting for a busy
+// language or repository don't keep the workers idle. It returns when
+// ctx is done, after the running checks finish.
+func (gc *gerritChecker) Serve(ctx context.Context) {
+	for _, s := range gc.sources {
+		go s.Run(ctx, gc.queue.push)
+	}
 
-		pending, err := c.server.PendingChecksByScheme(checkerScheme)
+	admitted := make(chan struct{}, 4*gc.pool.workers)
+	for {
+		admitted <- struct{}{}
+		p, err := gc.queue.pop(ctx)
 		if err != nil {
-			log.Printf("PendingChecksByScheme: %v", err)
-			continue
-		}
-
-		if len(pending) == 0 {
-			log.Printf("no pending checks")
-		}
-
-		for _, pc := range pending {
-			select {
-			case c.todo <- pc:
-			default:
-				log.Println("too busy; dropping pending check.")
+			log.Printf("stopping: %v", err)
+			// Wait for the running checks by taking all the slots.
+			for i := 1; i < cap(admitted); i++ {
+				admitted <- struct{}{}
 			}
+			return
 		}
+		go func(p *gerrit.PendingChecksInfo) {
+			defer func() { <-admitted }()
+			defer gc.queue.done(p)
+			if err := gc.executeCheck(p); err != nil {
+				log.Printf("executeCheck(%v): %v", p, err)
+			}
+		}(p)
 	}
 }
 
-// Serve runs the serve loop, executing formatters for checks that
-// need it.
-func (gc *gerritChecker) Serve() {
-	for p := range gc.todo {
-		// TODO: parallelism?.
-		if err := gc.executeCheck(p); err != nil {
-			log.Printf("executeCheck(%v): %v", p, err)
-		}
-	}
-}
-
-// status encodes the checker states.
-type status int
-
-var (
-	statusUnset      status = 0
-	statusIrrelevant status = 4
-	statusRunning    status = 1
-	statusFail       status = 2
-	statusSuccessful status = 3
-)
-
-func (s status) String() string {
-	return map[status]string{
-		statusUnset:      "UNSET",
-		statusIrrelevant: "IRRELEVANT",
-		statusRunning:    "RUNNING",
-		statusFail:       "FAILED",
-		statusSuccessful: "SUCCESSFUL",
-	}[s]
-}
-
-// executeCheck executes the pending checks specified in the argument.
+// executeCheck executes the pending checks specified in the
+// argument. The patchset is fetched once, and the checkers run
+// concurrently. Checks that are running or finished already are
+// skipped.
 func (gc *gerritChecker) executeCheck(pc *gerrit.PendingChecksInfo) error {
 	log.Println("checking", pc)
 
-	changeID := strconv.Itoa(pc.PatchSet.ChangeNumber)
-	psID := pc.PatchSet.PatchSetID
-	for uuid := range pc.PendingChecks {
-		now := gerrit.Timestamp(time.Now())
-		checkInput := gerrit.CheckInput{
-			CheckerUUID: uuid,
-			State:       statusRunning.String(),
-			Started:     &now,
+	ctx := context.Background()
+	snap := newSnapshot(gc.source, pc.PatchSet)
+	sinks := gc.sinksFor(pc.PatchSet.Repository)
+
+	type outcome struct {
+		result *checkResult
+		err    error
+	}
+	outcomes := make(chan outcome, len(pc.PendingChecks))
+	started := 0
+	for uuid, info := range pc.PendingChecks {
+		state := gerrit.StateNotStarted
+		if info != nil && info.State != "" {
+			state = info.State
 		}
-		log.Printf("posted %s", &checkInput)
-		_, err := gc.server.PostCheck(
-			changeID, psID, &checkInput)
-		if err != nil {
-			return err
+		if !state.IsPending() {
+			log.Printf("skipping %s on %v: state %s", uuid, pc.PatchSet, state)
+			continue
 		}
 
-		var status status
-		msg := ""
-		lang, ok := checkerLanguage(uuid)
-		if !ok {
-			return fmt.Errorf("uuid %q had unknown language", uuid)
-		} else {
-			msgs, err := gc.checkChange(changeID, psID, lang)
-			if err == errIrrelevant {
-				status = statusIrrelevant
-			} else if err != nil {
-				status = statusFail
-				log.Printf("checkChange(%s, %d, %q): %v", changeID, psID, lang, err)
-				msgs = []string{fmt.Sprintf("tool failure: %v", err)}
-			} else if len(msgs) == 0 {
-				status = statusSuccessful
-			} else {
-				status = statusFail
+		started++
+		go func(uuid string, state gerrit.CheckState) {
+			r, err := gc.runCheck(ctx, snap, sinks, uuid, state)
+			outcomes <- outcome{r, err}
+		}(uuid, state)
+	}
+
+	var firstErr error
+	var results []*checkResult
+	for i := 0; i < started; i++ {
+		o := <-outcomes
+		if o.result != nil {
+			results = append(results, o.result)
+		}
+		if o.err != nil {
+			log.Printf("executeCheck(%v): %v", pc.PatchSet, o.err)
+			if firstErr == nil {
+				firstErr = o.err
 			}
-			msg = strings.Join(msgs, ", ")
-			if len(msg) > 1000 {
-				msg = msg[:995] + "..."
+		}
+	}
+	if len(results) == 0 {
+		return firstErr
+	}
+
+	for _, s := range sinks {
+		if err := s.FinishPatchSet(ctx, pc.PatchSet, results); err != nil {
+			log.Printf("FinishPatchSet(%v): %v", pc.PatchSet, err)
+			if firstErr == nil {
+				firstErr = err
 			}
 		}
+	}
+	return firstErr
+}
 
-		log.Printf("status %s for lang %s on %v", status, lang, pc.PatchSet)
-		checkInput = gerrit.CheckInput{
-			CheckerUUID: uuid,
-			State:       status.String(),
-			Message:     msg,
+// runCheck runs a single checker on a patchset, starting from the
+// given pending state, and reports the result to the sinks. The result
+// is nil if the check did not run.
+func (gc *gerritChecker) runCheck(ctx context.Context, snap *snapshot, sinks []resultSink, uuid string, state gerrit.CheckState) (*checkResult, error) {
+	lang, ok := checkerLanguage(uuid)
+	if !ok {
+		return nil, fmt.Errorf("uuid %q had unknown language", uuid)
+	}
+
+	release, err := gc.pool.acquire(ctx, snap.ps.Repository, lang)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	r := &checkResult{
+		PatchSet:    snap.ps,
+		CheckerUUID: uuid,
+		Language:    lang,
+		Status:      state,
+	}
+	if err := r.transition(gerrit.StateRunning); err != nil {
+		return nil, err
+	}
+	r.Started = time.Now()
+	for _, s := range sinks {
+		if err := s.Start(ctx, r); err != nil {
+			return nil, err
 		}
-		log.Printf("posted %s", &checkInput)
+	}
 
-		if _, err := gc.server.PostCheck(changeID, psID, &checkInput); err != nil {
-			return err
+	var msgs []string
+	next := gerrit.StateFailed
+	files, skipped, err := gc.checkChange(ctx, snap, lang)
+	if err == errIrrelevant {
+		next = gerrit.StateNotRelevant
+	} else if err != nil {
+		log.Printf("checkChange(%v, %q): %v", snap.ps, lang, err)
+		msgs = []string{toolFailurePrefix + err.Error()}
+		r.ToolFailure = true
+	} else if len(files) == 0 {
+		next = gerrit.StateSuccessful
+	}
+	if err := r.transition(next); err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", f.Name, f.Message))
+	}
+	if len(skipped) > 0 {
+		msgs = append(msgs, "skipped "+strings.Join(skipped, ", "))
+	}
+	r.Message = strings.Join(msgs, ", ")
+	r.Files = files
+	r.Finished = time.Now()
+
+	log.Printf("status %s for lang %s on %v", r.Status, lang, snap.ps)
+	var firstErr error
+	for _, s := range sinks {
+		if err := s.Finish(ctx, r); err != nil && firstErr == nil {
+			firstErr = err
 		}
 	}
-	return nil
+	return r, firstErr
 }
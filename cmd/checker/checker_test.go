@@ -0,0 +1,368 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	linter "github.com/google/gerrit-linter"
+	"github.com/google/gerrit-linter/gerrit"
+	"github.com/google/gerrit-linter/gerrit/fake"
+)
+
+// newTestChecker returns a checker talking to a fake Gerrit, that
+// reports to the checks plugin and votes on Code-Style.
+func newTestChecker(t *testing.T) (*gerritChecker, *fake.Server) {
+	fs := fake.New()
+	g := gerrit.New(fs.GerritURL())
+	g.Retry.MaxAttempts = 1
+	gc, err := NewGerritChecker(g)
+	if err != nil {
+		fs.Close()
+		t.Fatal(err)
+	}
+	gc.sinks = map[string][]resultSink{
+		"*": {&checksSink{server: g}, &labelSink{server: g, label: "Code-Style"}},
+	}
+	return gc, fs
+}
+
+// pendingFor returns the pending checks of a checker on the fake.
+func pendingFor(t *testing.T, gc *gerritChecker, uuid string) *gerrit.PendingChecksInfo {
+	pending, err := gc.server.PendingChecksContext(context.Background(), uuid)
+	if err != nil {
+		t.Fatalf("PendingChecks: %v", err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("PendingChecks: got %d patchsets, want 1", len(pending))
+	}
+	return pending[0]
+}
+
+func TestExecuteCheck(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		msg       string
+		wantState gerrit.CheckState
+		wantMsg   string
+		wantVote  int
+	}{
+		{"ok", "Fix the frobnicator\n\nIt was broken.\n", gerrit.StateSuccessful, "", 1},
+		{"bad", "Fix the frobnicator.\n\nIt was broken.\n", gerrit.StateFailed, "subject must not end in '.'", -1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gc, fs := newTestChecker(t)
+			defer fs.Close()
+
+			uuid := checkerUUID("repo", "commitmsg")
+			fs.AddChecker(&gerrit.CheckerInput{UUID: uuid, Name: "commitmsg formatting", Repository: "repo", Status: "ENABLED"})
+			fs.AddPatchSet("repo", 1, 1, map[string]*gerrit.File{
+				"/COMMIT_MSG": {Status: "A", Content: []byte(tc.msg)},
+			})
+
+			before := time.Now().Add(-time.Second)
+			if err := gc.executeCheck(pendingFor(t, gc, uuid)); err != nil {
+				t.Fatalf("executeCheck: %v", err)
+			}
+
+			check := fs.Check(1, 1, uuid)
+			if check == nil {
+				t.Fatal("no check posted")
+			}
+			if check.State != tc.wantState {
+				t.Errorf("state: got %s, want %s", check.State, tc.wantState)
+			}
+			if !strings.Contains(check.Message, tc.wantMsg) {
+				t.Errorf("message: got %q, want it to contain %q", check.Message, tc.wantMsg)
+			}
+			if started := time.Time(check.Started); started.Before(before) {
+				t.Errorf("started: got %v, want after %v", started, before)
+			}
+			if finished := time.Time(check.Finished); finished.Before(time.Time(check.Started)) {
+				t.Errorf("finished: got %v, before started %v", finished, time.Time(check.Started))
+			}
+
+			reviews := fs.Reviews(1, 1)
+			if len(reviews) != 1 {
+				t.Fatalf("got %d reviews, want 1", len(reviews))
+			}
+			r := reviews[0]
+			if got := r.Labels["Code-Style"]; got != tc.wantVote {
+				t.Errorf("vote: got %d, want %d", got, tc.wantVote)
+			}
+			if r.Tag != reviewTag || !strings.Contains(r.Message, "commitmsg: "+string(tc.wantState)) {
+				t.Errorf("review: got tag %q, message %q", r.Tag, r.Message)
+			}
+
+			// The check is done, so there is nothing left to do.
+			pending, err := gc.server.PendingChecksContext(context.Background(), uuid)
+			if err != nil {
+				t.Fatalf("PendingChecks: %v", err)
+			}
+			if len(pending) != 0 {
+				t.Errorf("PendingChecks after executeCheck: got %d patchsets", len(pending))
+			}
+		})
+	}
+}
+
+func TestExecuteCheckVotesOnAllChecks(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		other    gerrit.CheckState
+		message  string
+		wantVote int
+	}{
+		{"other failed", gerrit.StateFailed, "a.go: not formatted", -1},
+		{"other passed", gerrit.StateSuccessful, "", 1},
+		{"other broken", gerrit.StateFailed, toolFailurePrefix + "exec: gofmt not found", 0},
+		{"other running", gerrit.StateRunning, "", 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gc, fs := newTestChecker(t)
+			defer fs.Close()
+			ctx := context.Background()
+
+			uuid := checkerUUID("repo", "commitmsg")
+			other := checkerUUID("repo", "go")
+			fs.AddChecker(&gerrit.CheckerInput{UUID: uuid, Repository: "repo", Status: "ENABLED"})
+			fs.AddChecker(&gerrit.CheckerInput{UUID: other, Repository: "repo", Status: "ENABLED"})
+			fs.AddPatchSet("repo", 1, 1, map[string]*gerrit.File{
+				"/COMMIT_MSG": {Status: "A", Content: []byte("Subject\n")},
+			})
+
+			// The other checker ran earlier; only commitmsg is rerun.
+			for _, st := range []gerrit.CheckState{gerrit.StateRunning, tc.other} {
+				if _, err := gc.server.PostCheckContext(ctx, "1", 1, &gerrit.CheckInput{CheckerUUID: other, State: st, Message: tc.message}); err != nil {
+					t.Fatalf("PostCheck(%s): %v", st, err)
+				}
+			}
+			pc := pendingInfo(&gerrit.CheckablePatchSetInfo{Repository: "repo", ChangeNumber: 1, PatchSetID: 1}, []string{uuid})
+			if err := gc.executeCheck(pc); err != nil {
+				t.Fatalf("executeCheck: %v", err)
+			}
+
+			if c := fs.Check(1, 1, uuid); c == nil || c.State != gerrit.StateSuccessful {
+				t.Fatalf("got check %+v, want %s", c, gerrit.StateSuccessful)
+			}
+			reviews := fs.Reviews(1, 1)
+			if len(reviews) != 1 {
+				t.Fatalf("got %d reviews, want 1", len(reviews))
+			}
+			r := reviews[0]
+			if got := r.Labels["Code-Style"]; got != tc.wantVote {
+				t.Errorf("vote: got %d, want %d", got, tc.wantVote)
+			}
+			if !strings.Contains(r.Message, "go: "+string(tc.other)) {
+				t.Errorf("review message %q doesn't mention the other check", r.Message)
+			}
+		})
+	}
+}
+
+// lowerFormatter formats files by lowercasing them.
+type lowerFormatter struct{}
+
+func (lowerFormatter) Format(in []linter.File, outSink io.Writer) ([]linter.FormattedFile, error) {
+	var out []linter.FormattedFile
+	for _, f := range in {
+		ff := linter.FormattedFile{File: f}
+		ff.Content = bytes.ToLower(f.Content)
+		if !bytes.Equal(ff.Content, f.Content) {
+			ff.Message = "not lowercase"
+		}
+		out = append(out, ff)
+	}
+	return out, nil
+}
+
+func TestExecuteCheckFileTypes(t *testing.T) {
+	linter.Formatters["lower"] = &linter.FormatterConfig{
+		Regex:     regexp.MustCompile(`\.txt$`),
+		Formatter: lowerFormatter{},
+	}
+	defer delete(linter.Formatters, "lower")
+
+	gc, fs := newTestChecker(t)
+	defer fs.Close()
+	gc.modePolicy = true
+
+	uuid := checkerUUID("repo", "lower")
+	fs.AddChecker(&gerrit.CheckerInput{UUID: uuid, Repository: "repo", Status: "ENABLED"})
+	fs.AddPatchSet("repo", 1, 1, map[string]*gerrit.File{
+		"ok.txt":     {Status: "M", OldMode: 0100644, NewMode: 0100644, Content: []byte("ok\n")},
+		"link.txt":   {Status: "A", NewMode: 0120000, Content: []byte("TARGET")},
+		"sub.txt":    {Status: "A", NewMode: 0160000},
+		"blob.txt":   {Status: "A", NewMode: 0100644, Binary: true, Content: []byte("BIN\x00")},
+		"run.txt":    {Status: "M", OldMode: 0100644, NewMode: 0100755, Content: []byte("run\n")},
+		"script.txt": {Status: "M", OldMode: 0100755, NewMode: 0100755, Content: []byte("script\n")},
+		"both.txt":   {Status: "A", NewMode: 0100755, Content: []byte("BOTH\n")},
+	})
+
+	if err := gc.executeCheck(pendingFor(t, gc, uuid)); err != nil {
+		t.Fatalf("executeCheck: %v", err)
+	}
+	check := fs.Check(1, 1, uuid)
+	if check == nil {
+		t.Fatal("no check posted")
+	}
+	if check.State != gerrit.StateFailed {
+		t.Errorf("state: got %s, want %s", check.State, gerrit.StateFailed)
+	}
+	want := "both.txt: executable bit set; not lowercase, " +
+		"run.txt: executable bit set, " +
+		"skipped blob.txt: binary, link.txt: symlink, sub.txt: gitlink"
+	if check.Message != want {
+		t.Errorf("message:\ngot  %q\nwant %q", check.Message, want)
+	}
+}
+
+func TestExecuteCheckSkipsFinished(t *testing.T) {
+	gc, fs := newTestChecker(t)
+	defer fs.Close()
+
+	uuid := checkerUUID("repo", "commitmsg")
+	fs.AddChecker(&gerrit.CheckerInput{UUID: uuid, Repository: "repo", Status: "ENABLED"})
+	fs.AddPatchSet("repo", 1, 1, map[string]*gerrit.File{
+		"/COMMIT_MSG": {Status: "A", Content: []byte("Subject.\n")},
+	})
+
+	pc := pendingInfo(&gerrit.CheckablePatchSetInfo{Repository: "repo", ChangeNumber: 1, PatchSetID: 1}, []string{uuid})
+	pc.PendingChecks[uuid].State = gerrit.StateSuccessful
+	if err := gc.executeCheck(pc); err != nil {
+		t.Fatalf("executeCheck: %v", err)
+	}
+	if c := fs.Check(1, 1, uuid); c != nil {
+		t.Errorf("got check %+v, want none", c)
+	}
+	if r := fs.Reviews(1, 1); len(r) != 0 {
+		t.Errorf("got reviews %+v, want none", r)
+	}
+}
+
+func TestServeStops(t *testing.T) {
+	gc, fs := newTestChecker(t)
+	defer fs.Close()
+	gc.sources = nil
+
+	uuid := checkerUUID("repo", "commitmsg")
+	fs.AddChecker(&gerrit.CheckerInput{UUID: uuid, Repository: "repo", Status: "ENABLED"})
+	fs.AddPatchSet("repo", 1, 1, map[string]*gerrit.File{
+		"/COMMIT_MSG": {Status: "A", Content: []byte("Subject\n")},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := gc.queue.push(ctx, pendingFor(t, gc, uuid)); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		gc.Serve(ctx)
+		close(done)
+	}()
+	// Cancel once the patchset was taken off the queue.
+	for gc.queue.dequeued.Value() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Serve didn't return after cancel")
+	}
+
+	// A check that was started is finished before Serve returns.
+	if c := fs.Check(1, 1, uuid); c == nil || !c.State.IsTerminal() {
+		t.Errorf("got check %+v after Serve returned, want a terminal state", c)
+	}
+}
+
+func TestPendingFor(t *testing.T) {
+	gc, fs := newTestChecker(t)
+	defer fs.Close()
+	ctx := context.Background()
+
+	uuid := checkerUUID("repo", "commitmsg")
+	fs.AddChecker(&gerrit.CheckerInput{UUID: uuid, Repository: "repo", Status: "ENABLED"})
+	fs.AddChecker(&gerrit.CheckerInput{UUID: checkerUUID("repo", "cobol"), Repository: "repo", Status: "ENABLED"})
+	fs.AddChecker(&gerrit.CheckerInput{UUID: checkerUUID("other", "commitmsg"), Repository: "other", Status: "ENABLED"})
+	fs.AddChecker(&gerrit.CheckerInput{UUID: checkerUUID("off", "commitmsg"), Repository: "off", Status: "DISABLED"})
+	fs.AddPatchSet("repo", 1, 1, map[string]*gerrit.File{})
+	fs.AddPatchSet("off", 2, 1, map[string]*gerrit.File{})
+
+	listed := 0
+	fs.Fail = func(req *http.Request) int {
+		if strings.HasSuffix(req.URL.Path, "/checkers/") {
+			listed++
+		}
+		return 0
+	}
+
+	ps := &gerrit.CheckablePatchSetInfo{Repository: "repo", ChangeNumber: 1, PatchSetID: 1}
+	states := func(rerun bool) map[string]gerrit.CheckState {
+		pc, err := gc.pendingFor(ctx, ps, nil, rerun)
+		if err != nil {
+			t.Fatalf("pendingFor: %v", err)
+		}
+		out := map[string]gerrit.CheckState{}
+		for u, p := range pc.PendingChecks {
+			out[u] = p.State
+		}
+		return out
+	}
+
+	// Only the registered checker for a supported language runs.
+	if got, want := states(false), map[string]gerrit.CheckState{uuid: gerrit.StateNotStarted}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pendingFor: got %v, want %v", got, want)
+	}
+
+	// Finished checks don't run again, unless rerun.
+	for _, st := range []gerrit.CheckState{gerrit.StateRunning, gerrit.StateSuccessful} {
+		if _, err := gc.server.PostCheckContext(ctx, "1", 1, &gerrit.CheckInput{CheckerUUID: uuid, State: st}); err != nil {
+			t.Fatalf("PostCheck: %v", err)
+		}
+	}
+	if got := states(false); len(got) != 0 {
+		t.Errorf("pendingFor after the check finished: got %v, want none", got)
+	}
+	if got, want := states(true), map[string]gerrit.CheckState{uuid: gerrit.StateNotStarted}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pendingFor with rerun: got %v, want %v", got, want)
+	}
+	if listed != 1 {
+		t.Errorf("listed checkers %d times, want 1", listed)
+	}
+
+	// Disabled checkers don't run.
+	if _, err := gc.pendingFor(ctx, &gerrit.CheckablePatchSetInfo{Repository: "off", ChangeNumber: 2, PatchSetID: 1}, nil, false); err != errNoCheckers {
+		t.Errorf("pendingFor on a disabled checker: got %v, want %v", err, errNoCheckers)
+	}
+
+	// Without the checks plugin, there is a checker per language.
+	gc.sinks = map[string][]resultSink{"*": {&labelSink{server: gc.server, label: "Code-Style"}}}
+	gc.sources = nil
+	gc.languages = []string{"commitmsg"}
+	if got, want := states(false), map[string]gerrit.CheckState{uuid: gerrit.StateNotStarted}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pendingFor without the checks plugin: got %v, want %v", got, want)
+	}
+}
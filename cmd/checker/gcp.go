@@ -21,6 +21,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -33,15 +34,56 @@ type gcpToken struct {
 	AccessToken string `json:"access_token"`
 	ExpiresIn   int    `json:"expires_in"`
 	TokenType   string `json:"token_type"`
+
+	// expiry is computed from ExpiresIn when the token is fetched.
+	expiry time.Time
+}
+
+// valid returns whether the token can still be used.
+func (t *gcpToken) valid(now time.Time) bool {
+	return t != nil && now.Before(t.expiry)
 }
 
-// tokenCache fetches a bearer token from the GCP metadata service,
-// and refreshes it before it expires.
+// defaultMetadataHost is the GCP metadata server. It can be
+// overridden with the GCE_METADATA_HOST environment variable.
+const defaultMetadataHost = "metadata.google.internal"
+
+// metadataHost returns the metadata server to use by default.
+func metadataHost() string {
+	if h := os.Getenv("GCE_METADATA_HOST"); h != "" {
+		return h
+	}
+	return defaultMetadataHost
+}
+
+const (
+	// refreshMargin is how long before expiry a token is refreshed.
+	refreshMargin = 5 * time.Minute
+
+	// minRefreshDelay is the shortest wait between refreshes, and
+	// the first delay after a failed one.
+	minRefreshDelay = time.Second
+
+	// maxRefreshBackoff caps the delay between failed refreshes.
+	maxRefreshBackoff = time.Minute
+)
+
+// tokenCache holds a bearer token, and refreshes it before it
+// expires. If refreshing fails, the current token is used until it
+// expires.
 type tokenCache struct {
-	account string
+	// fetch gets a new token.
+	fetch func() (*gcpToken, error)
 
 	mu      sync.Mutex
 	current *gcpToken
+
+	// stale is set if the server rejected the current token.
+	stale bool
+
+	// backoff is the delay after the next failed refresh. It is only
+	// used by the refresh loop.
+	backoff time.Duration
 }
 
 // Implement the Authenticator interface.
@@ -49,84 +91,138 @@ func (tc *tokenCache) Authenticate(req *http.Request) error {
 	tc.mu.Lock()
 	defer tc.mu.Unlock()
 
-	if tc.current == nil {
-		return fmt.Errorf("no token")
+	if tc.stale || !tc.current.valid(time.Now()) {
+		tok, err := tc.fetch()
+		if err != nil {
+			return err
+		}
+		tc.current = tok
+		tc.stale = false
 	}
 
 	req.Header.Set("Authorization", "Bearer "+tc.current.AccessToken)
 	return nil
 }
 
+// Invalidate makes the next request fetch a new token.
+func (tc *tokenCache) Invalidate() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.stale = true
+}
+
 // The name of the scope that is necessary to access googlesource.com
 // gerrit instances.
 const gerritScope = "https://www.googleapis.com/auth/gerritcodereview"
 
+// metadataServer gets tokens for a service account from the GCP
+// metadata server.
+type metadataServer struct {
+	account string
+
+	// host is the metadata server, as host[:port].
+	host   string
+	client *http.Client
+}
+
 // scopeURL returns the URL where GCP serves scopes for an account.
-func scopeURL(account string) string {
-	return fmt.Sprintf("http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/%s/scopes",
-		account)
+func (m *metadataServer) scopeURL() string {
+	return fmt.Sprintf("http://%s/computeMetadata/v1/instance/service-accounts/%s/scopes",
+		m.host, m.account)
 }
 
 // tokenURL returns the URL where GCP serves tokens for an account.
-func tokenURL(account string) string {
-	return fmt.Sprintf("http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/%s/token",
-		account)
+func (m *metadataServer) tokenURL() string {
+	return fmt.Sprintf("http://%s/computeMetadata/v1/instance/service-accounts/%s/token",
+		m.host, m.account)
 }
 
-// fetchScopes returns the scopes for the configured service account.
-func (tc *tokenCache) fetchScopes() ([]string, error) {
-	req, err := http.NewRequest("GET", scopeURL(tc.account), nil)
+// getMetadata runs a GET on the metadata server.
+func (m *metadataServer) getMetadata(u string) ([]byte, error) {
+	req, err := http.NewRequest("GET", u, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Metadata-Flavor", "Google")
 
-	resp, err := http.DefaultClient.Do(req.WithContext(context.Background()))
+	resp, err := m.client.Do(req.WithContext(context.Background()))
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	all, _ := ioutil.ReadAll(resp.Body)
+	all, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
 
-	return strings.Split(strings.TrimSpace(string(all)), "\n"), nil
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s failed (%d): %s", u, resp.StatusCode, string(all))
+	}
+	return all, nil
 }
 
-// fetch gets the token from the metadata server.
-func (tc *tokenCache) fetchToken() (*gcpToken, error) {
-	req, err := http.NewRequest("GET", tokenURL(tc.account), nil)
+// fetchScopes returns the scopes for the configured service account.
+func (m *metadataServer) fetchScopes() ([]string, error) {
+	all, err := m.getMetadata(m.scopeURL())
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Metadata-Flavor", "Google")
+	return strings.Split(strings.TrimSpace(string(all)), "\n"), nil
+}
 
-	resp, err := http.DefaultClient.Do(req.WithContext(context.Background()))
+// fetchToken gets the token from the metadata server.
+func (m *metadataServer) fetchToken() (*gcpToken, error) {
+	now := time.Now()
+	all, err := m.getMetadata(m.tokenURL())
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	all, _ := ioutil.ReadAll(resp.Body)
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%v failed (%d): %s", req, resp.StatusCode, string(all))
-	}
+	return parseToken(all, now)
+}
 
+// parseToken parses an OAuth2 token response received at now.
+func parseToken(all []byte, now time.Time) (*gcpToken, error) {
 	tok := &gcpToken{}
 	if err := json.Unmarshal(all, tok); err != nil {
 		return nil, fmt.Errorf("can't unmarshal %s: %v", string(all), err)
 	}
-
+	if tok.AccessToken == "" {
+		return nil, fmt.Errorf("no access token in %s", string(all))
+	}
+	tok.expiry = now.Add(time.Duration(tok.ExpiresIn) * time.Second)
 	return tok, nil
 }
 
+// newTokenCache creates a tokenCache, fetches the first token, and
+// starts refreshing it.
+func newTokenCache(fetch func() (*gcpToken, error)) (*tokenCache, error) {
+	tok, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	tc := &tokenCache{
+		fetch:   fetch,
+		current: tok,
+	}
+	go tc.loop()
+	return tc, nil
+}
+
 // NewGCPServiceAccount returns a Authenticator that will use GCP
 // bearer-tokens to authenticate against a googlesource.com Gerrit
-// instance. The tokens are refreshed automatically.
-func NewGCPServiceAccount(account string) (gerrit.Authenticator, error) {
-	tc := tokenCache{
+// instance. The tokens are refreshed automatically. host is the
+// metadata server; if empty, GCE_METADATA_HOST or the default is used.
+func NewGCPServiceAccount(account, host string) (gerrit.Authenticator, error) {
+	if host == "" {
+		host = metadataHost()
+	}
+	m := &metadataServer{
 		account: account,
+		host:    host,
+		client:  &http.Client{Timeout: 10 * time.Second},
 	}
 
-	scopes, err := tc.fetchScopes()
+	scopes, err := m.fetchScopes()
 	if err != nil {
 		return nil, err
 	}
@@ -142,31 +238,58 @@ func NewGCPServiceAccount(account string) (gerrit.Authenticator, error) {
 		return nil, fmt.Errorf("missing scope %q, got %q", gerritScope, scopes)
 	}
 
-	tc.current, err = tc.fetchToken()
-	if err != nil {
-		return nil, err
+	return newTokenCache(m.fetchToken)
+}
+
+// refreshDelay returns how long to wait before refreshing a token. It
+// is at least minRefreshDelay, even for tokens that are about to
+// expire or have expired.
+func refreshDelay(tok *gcpToken, now time.Time) time.Duration {
+	left := tok.expiry.Sub(now)
+	margin := refreshMargin
+	if margin > left/2 {
+		// Short-lived token: refresh halfway.
+		margin = left / 2
 	}
+	if d := left - margin; d > minRefreshDelay {
+		return d
+	}
+	return minRefreshDelay
+}
 
-	go tc.loop()
+// refresh fetches a new token, and returns how long to wait before the
+// next refresh. If fetching fails, the current token remains in use,
+// and the delay backs off exponentially.
+func (tc *tokenCache) refresh() time.Duration {
+	tok, err := tc.fetch()
+	if err != nil {
+		delay := tc.backoff
+		if delay < minRefreshDelay {
+			delay = minRefreshDelay
+		}
+		log.Printf("fetching token failed: %s, retrying in %v", err, delay)
+		if tc.backoff = 2 * delay; tc.backoff > maxRefreshBackoff {
+			tc.backoff = maxRefreshBackoff
+		}
+		return delay
+	}
 
-	return &tc, nil
+	tc.backoff = minRefreshDelay
+	tc.mu.Lock()
+	tc.current = tok
+	tc.stale = false
+	tc.mu.Unlock()
+	return refreshDelay(tok, time.Now())
 }
 
-// loop refreshes the token periodically.
+// loop refreshes the token ahead of its expiry.
 func (tc *tokenCache) loop() {
-	delaySecs := tc.current.ExpiresIn - 1
-	for {
-		time.Sleep(time.Duration(delaySecs) * time.Second)
-		tok, err := tc.fetchToken()
-		if err != nil {
-			log.Printf("fetching token failed:  %s", err)
-			delaySecs = 2
-		} else {
-			delaySecs = tok.ExpiresIn - 1
-		}
+	tc.mu.Lock()
+	delay := refreshDelay(tc.current, time.Now())
+	tc.mu.Unlock()
 
-		tc.mu.Lock()
-		tc.current = tok
-		tc.mu.Unlock()
+	for {
+		time.Sleep(delay)
+		delay = tc.refresh()
 	}
 }
@@ -0,0 +1,179 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMetadata is a GCP metadata server that hands out tokens t1, t2,
+// ... for account "sa".
+type fakeMetadata struct {
+	mu     sync.Mutex
+	scopes []string
+	fail   bool
+	issued int
+}
+
+func (m *fakeMetadata) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Metadata-Flavor") != "Google" {
+		http.Error(w, "missing Metadata-Flavor", http.StatusForbidden)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch r.URL.Path {
+	case "/computeMetadata/v1/instance/service-accounts/sa/scopes":
+		fmt.Fprintln(w, strings.Join(m.scopes, "\n"))
+	case "/computeMetadata/v1/instance/service-accounts/sa/token":
+		if m.fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		m.issued++
+		fmt.Fprintf(w, `{"access_token":"t%d","expires_in":3600,"token_type":"Bearer"}`, m.issued)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (m *fakeMetadata) setFail(fail bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fail = fail
+}
+
+// authorization returns the Authorization header that tc sets.
+func authorization(t *testing.T, tc *tokenCache) (string, error) {
+	req, err := http.NewRequest("GET", "http://gerrit/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.Authenticate(req); err != nil {
+		return "", err
+	}
+	return req.Header.Get("Authorization"), nil
+}
+
+func newTestTokenCache(t *testing.T, md *fakeMetadata) (*tokenCache, func()) {
+	ts := httptest.NewServer(md)
+	auth, err := NewGCPServiceAccount("sa", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		ts.Close()
+		t.Fatalf("NewGCPServiceAccount: %v", err)
+	}
+	return auth.(*tokenCache), ts.Close
+}
+
+func TestGCPTokenKeptOnFailedRefresh(t *testing.T) {
+	md := &fakeMetadata{scopes: []string{"email", gerritScope}}
+	tc, done := newTestTokenCache(t, md)
+	defer done()
+
+	if got, err := authorization(t, tc); err != nil || got != "Bearer t1" {
+		t.Fatalf("Authenticate: got %q, %v, want Bearer t1", got, err)
+	}
+
+	md.setFail(true)
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		if got := tc.refresh(); got != want {
+			t.Errorf("refresh: got delay %v, want %v", got, want)
+		}
+	}
+	if got, err := authorization(t, tc); err != nil || got != "Bearer t1" {
+		t.Errorf("Authenticate after failed refresh: got %q, %v, want Bearer t1", got, err)
+	}
+
+	md.setFail(false)
+	if got := tc.refresh(); got < 54*time.Minute || got > 55*time.Minute {
+		t.Errorf("refresh: got delay %v, want about 55m", got)
+	}
+	if got, err := authorization(t, tc); err != nil || got != "Bearer t2" {
+		t.Errorf("Authenticate after refresh: got %q, %v, want Bearer t2", got, err)
+	}
+}
+
+func TestGCPTokenExpiry(t *testing.T) {
+	md := &fakeMetadata{scopes: []string{gerritScope}}
+	tc, done := newTestTokenCache(t, md)
+	defer done()
+
+	tc.mu.Lock()
+	tc.current.expiry = time.Now().Add(-time.Second)
+	tc.mu.Unlock()
+
+	// An expired token is never used, even if there is no other.
+	md.setFail(true)
+	if got, err := authorization(t, tc); err == nil {
+		t.Errorf("Authenticate with expired token: got %q, want error", got)
+	}
+
+	md.setFail(false)
+	if got, err := authorization(t, tc); err != nil || got != "Bearer t2" {
+		t.Errorf("Authenticate after expiry: got %q, %v, want Bearer t2", got, err)
+	}
+}
+
+func TestGCPTokenInvalidate(t *testing.T) {
+	md := &fakeMetadata{scopes: []string{gerritScope}}
+	tc, done := newTestTokenCache(t, md)
+	defer done()
+
+	if got, err := authorization(t, tc); err != nil || got != "Bearer t1" {
+		t.Fatalf("Authenticate: got %q, %v, want Bearer t1", got, err)
+	}
+	tc.Invalidate()
+	if got, err := authorization(t, tc); err != nil || got != "Bearer t2" {
+		t.Errorf("Authenticate after Invalidate: got %q, %v, want Bearer t2", got, err)
+	}
+	if got, err := authorization(t, tc); err != nil || got != "Bearer t2" {
+		t.Errorf("Authenticate again: got %q, %v, want Bearer t2", got, err)
+	}
+}
+
+func TestGCPMissingScope(t *testing.T) {
+	ts := httptest.NewServer(&fakeMetadata{scopes: []string{"email"}})
+	defer ts.Close()
+	if _, err := NewGCPServiceAccount("sa", strings.TrimPrefix(ts.URL, "http://")); err == nil {
+		t.Errorf("NewGCPServiceAccount without gerrit scope: got nil error")
+	}
+}
+
+func TestRefreshDelay(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		expiresIn time.Duration
+		want      time.Duration
+	}{
+		{time.Hour, 55 * time.Minute},
+		{10 * time.Minute, 5 * time.Minute},
+		{2 * time.Minute, time.Minute},
+		{time.Second, minRefreshDelay},
+		{0, minRefreshDelay},
+		{-time.Minute, minRefreshDelay},
+	} {
+		tok := &gcpToken{expiry: now.Add(tc.expiresIn)}
+		if got := refreshDelay(tok, now); got != tc.want {
+			t.Errorf("refreshDelay for a token expiring in %v: got %v, want %v", tc.expiresIn, got, tc.want)
+		}
+	}
+}
@@ -15,17 +15,88 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"flag"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
 
 	linter "github.com/google/gerrit-linter"
 	"github.com/google/gerrit-linter/gerrit"
 )
 
+// regexpList is a flag.Value for a repeatable regular expression flag.
+type regexpList []*regexp.Regexp
+
+func (l *regexpList) String() string {
+	var s []string
+	for _, r := range *l {
+		s = append(s, r.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *regexpList) Set(v string) error {
+	r, err := regexp.Compile(v)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, r)
+	return nil
+}
+
+// stringList is a flag.Value for a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// parseCommand parses a command line. A JSON list is taken as the
+// arguments verbatim; otherwise the command is split on whitespace,
+// without shell quoting.
+func parseCommand(s string) ([]string, error) {
+	var args []string
+	if strings.HasPrefix(strings.TrimSpace(s), "[") {
+		if err := json.Unmarshal([]byte(s), &args); err != nil {
+			return nil, err
+		}
+	} else {
+		args = strings.Fields(s)
+	}
+	if len(args) == 0 || args[0] == "" {
+		return nil, errors.New("empty command")
+	}
+	return args, nil
+}
+
+// readSecret returns the trimmed content of a secret file, or "" if
+// no file is given.
+func readSecret(name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
 func main() {
 	gerritURL := flag.String("gerrit", "", "URL to gerrit host")
 	register := flag.Bool("register", false, "Register with the host")
@@ -33,10 +104,60 @@ func main() {
 	list := flag.Bool("list", false, "List pending checks")
 	agent := flag.String("agent", "fmtserver", "user-agent for the fmtserver.")
 	gcpServiceAccount := flag.String("gcp_service_account", "", "A GCP service account ID to run this as")
+	gcpMetadataHost := flag.String("gcp_metadata_host", "", "GCP metadata server for --gcp_service_account. Defaults to $GCE_METADATA_HOST or "+defaultMetadataHost)
+	serviceAccountKey := flag.String("service_account_key", "", "service account JSON key file to get tokens with")
+	tokenEndpoint := flag.String("token_endpoint", "", "OAuth2 token endpoint for --service_account_key. Defaults to the token_uri of the key.")
 	authFile := flag.String("auth_file", "", "file containing user:password")
+	gitCookies := flag.String("gitcookies", "", ".gitcookies file with the cookie for the host")
+	netrc := flag.String("netrc", "", ".netrc file with the login for the host")
+	authCommand := flag.String("auth_command", "", "credential helper command to run for the login, split on spaces, or as a JSON list of arguments. See README for the protocol.")
+	gitCredential := flag.Bool("git_credential", false, "get the login from \"git credential fill\"")
+	authTTL := flag.Duration("auth_ttl", 10*time.Minute, "how long to cache the login from --auth_command or --git_credential")
 	repo := flag.String("repo", "", "the repository (project) name to apply the checker to.")
 	language := flag.String("language", "", "the language that the checker should apply to.")
+	qps := flag.Float64("qps", 0, "maximum rate of requests to the Gerrit host. 0 means unlimited.")
+	burst := flag.Int("burst", 10, "maximum burst of requests to the Gerrit host, if --qps is set.")
+	maxAttempts := flag.Int("max_attempts", gerrit.DefaultRetryPolicy.MaxAttempts, "number of attempts for failing idempotent requests.")
+	fetchParallelism := flag.Int("fetch_parallelism", 8, "number of concurrent file content requests per change.")
+	fetchArchive := flag.Bool("fetch_archive", false, "fetch change contents as a single archive.")
+	maxChangeSize := flag.Int64("max_change_size", 0, "maximum total size in bytes of the files of a change. 0 means unlimited.")
+	gitMirror := flag.String("git_mirror", "", "directory for bare git mirrors. If set, change contents are read from git.")
+	gitRemote := flag.String("git_remote", "", "base URL for fetching into --git_mirror. Defaults to --gerrit.")
+	caFile := flag.String("ca_file", "", "PEM file with extra certificate authorities to trust for the Gerrit host.")
+	certFile := flag.String("cert_file", "", "PEM client certificate for mutual TLS. Reloaded when it changes.")
+	keyFile := flag.String("key_file", "", "PEM client key for --cert_file.")
+	proxy := flag.String("proxy", "", "URL of the HTTP proxy for the Gerrit host. Default: from the environment.")
+	dialTimeout := flag.Duration("dial_timeout", 30*time.Second, "timeout for connecting to the Gerrit host.")
+	tlsTimeout := flag.Duration("tls_timeout", 10*time.Second, "timeout for the TLS handshake with the Gerrit host.")
+	responseTimeout := flag.Duration("response_header_timeout", 0, "timeout for response headers from the Gerrit host. 0 means no limit.")
+	recordDir := flag.String("record_dir", "", "directory to record Gerrit HTTP interactions into.")
+	replayDir := flag.String("replay_dir", "", "directory to replay Gerrit HTTP interactions from, instead of contacting the host.")
+	modePolicy := flag.Bool("mode_policy", false, "complain about source files that become executable.")
+	label := flag.String("label", "", "label to vote on with the \"label\" sink, eg. Code-Style.")
+	resultsFile := flag.String("results_file", "", "file to append results to with the \"jsonl\" sink.")
+	var sinkSpecs stringList
+	flag.Var(&sinkSpecs, "sink", "result sinks, as [REPO=]SINK,SINK... May be repeated. "+
+		"Sinks are checks, label, comments, jsonl and stdout. Default: checks")
+	sources := flag.String("sources", "pending", "comma separated work sources: pending (checks plugin), query.")
+	query := flag.String("query", "status:open -age:1d", "change query for the \"query\" source. It runs on every poll, so keep it bounded.")
+	pollInterval := flag.Duration("poll_interval", 10*time.Second, "interval for polling sources. Defaults to 5m if --http is set.")
+	httpAddr := flag.String("http", "", "address to serve the /webhook endpoint on, eg. :8080.")
+	webhookSecretFile := flag.String("webhook_secret_file", "", "file containing the shared secret that /webhook requests must carry.")
+	adminAddr := flag.String("admin_http", "", "address to serve the /enqueue and /debug/vars endpoints on, eg. localhost:8081.")
+	enqueueSecretFile := flag.String("enqueue_secret_file", "", "file containing the secret that /enqueue requests must carry as a bearer token. Defaults to --webhook_secret_file.")
+	recheck := flag.String("recheck_pattern", defaultRecheckPattern, "regexp for comments that trigger a new check through /webhook.")
+	queueSize := flag.Int("queue_size", 100, "number of patchsets that may wait to be checked. Sources wait while the queue is full.")
+	workers := flag.Int("workers", runtime.NumCPU(), "number of checks to run concurrently.")
+	languageWorkers := flag.String("language_workers", "", "per-language limits on concurrent checks, eg. java=1,go=4.")
+	repoWorkers := flag.String("repo_workers", "", "per-repository limits on concurrent checks, eg. gerrit=2,*=1. \"*\" applies to all other repositories.")
+	languages := flag.String("languages", "", "comma separated languages to check for patchsets from the query, webhook and enqueue sources. Default: all supported")
+	var generatedMarkers regexpList
+	flag.Var(&generatedMarkers, "generated_marker", "regexp marking file content as generated. May be repeated. Default: "+
+		linter.GeneratedMarkers[0].String())
 	flag.Parse()
+	if len(generatedMarkers) > 0 {
+		linter.GeneratedMarkers = generatedMarkers
+	}
 	if *gerritURL == "" {
 		log.Fatal("must set --gerrit")
 	}
@@ -46,27 +167,107 @@ func main() {
 		log.Fatalf("url.Parse: %v", err)
 	}
 
-	if (*authFile == "" && *gcpServiceAccount == "") || (*authFile != "" && *gcpServiceAccount != "") {
-		log.Fatal("must set one of --auth_file or --gcp_service_account")
+	authFlags := 0
+	for _, f := range []string{*authFile, *gcpServiceAccount, *serviceAccountKey, *gitCookies, *netrc, *authCommand} {
+		if f != "" {
+			authFlags++
+		}
+	}
+	if *gitCredential {
+		authFlags++
+	}
+	if authFlags != 1 {
+		log.Fatal("must set one of --auth_file, --gcp_service_account, --service_account_key, --gitcookies, --netrc, --auth_command or --git_credential")
 	}
 
 	g := gerrit.New(*u)
 
 	g.UserAgent = *agent
+	g.Retry.MaxAttempts = *maxAttempts
+	g.Fetch = gerrit.FetchOptions{
+		Parallelism:  *fetchParallelism,
+		MaxTotalSize: *maxChangeSize,
+		Archive:      *fetchArchive,
+	}
+	transport, err := gerrit.NewTransport(&gerrit.TransportOptions{
+		CAFile:                *caFile,
+		CertFile:              *certFile,
+		KeyFile:               *keyFile,
+		Proxy:                 *proxy,
+		DialTimeout:           *dialTimeout,
+		TLSHandshakeTimeout:   *tlsTimeout,
+		ResponseHeaderTimeout: *responseTimeout,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	g.Client.Transport = transport
+
+	if *recordDir != "" && *replayDir != "" {
+		log.Fatal("cannot set both --record_dir and --replay_dir")
+	}
+	if *recordDir != "" {
+		rec, err := gerrit.NewRecorder(*recordDir, gerrit.Record)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rec.Transport = transport
+		g.Client.Transport = rec
+	}
+	if *replayDir != "" {
+		rec, err := gerrit.NewRecorder(*replayDir, gerrit.Replay)
+		if err != nil {
+			log.Fatal(err)
+		}
+		g.Client.Transport = rec
+	}
+	if *qps != 0 {
+		g.RateLimiter, err = gerrit.NewRateLimiter(*qps, *burst)
+		if err != nil {
+			log.Fatalf("--qps: %v", err)
+		}
+	}
 
 	if *authFile != "" {
-		content, err := ioutil.ReadFile(*authFile)
+		g.Authenticator, err = gerrit.NewBasicAuthFile(*authFile)
 		if err != nil {
 			log.Fatal(err)
 		}
-		g.Authenticator = gerrit.NewBasicAuth(string(content))
 	}
 	if *gcpServiceAccount != "" {
-		g.Authenticator, err = NewGCPServiceAccount(*gcpServiceAccount)
+		g.Authenticator, err = NewGCPServiceAccount(*gcpServiceAccount, *gcpMetadataHost)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *serviceAccountKey != "" {
+		g.Authenticator, err = NewServiceAccountKey(*serviceAccountKey, *tokenEndpoint)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *gitCookies != "" {
+		g.Authenticator, err = gerrit.NewGitCookies(*gitCookies)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *netrc != "" {
+		g.Authenticator, err = gerrit.NewNetrc(*netrc)
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
+	if *authCommand != "" {
+		command, err := parseCommand(*authCommand)
+		if err != nil {
+			log.Fatalf("--auth_command: %v", err)
+		}
+		g.Authenticator = gerrit.NewCommandAuth(command, *authTTL)
+	}
+	if *gitCredential {
+		g.Authenticator = gerrit.NewGitCredentialAuth(*authTTL)
+	}
 
 	// Do a GET first to complete any cookie dance, because POST
 	// aren't redirected properly. Also, this avoids spamming logs with
@@ -80,6 +281,122 @@ func main() {
 		log.Fatal(err)
 	}
 
+	gc.modePolicy = *modePolicy
+	gc.sinks, err = parseSinks(sinkSpecs, &sinkOptions{
+		server:      g,
+		label:       *label,
+		resultsFile: *resultsFile,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *gitMirror != "" {
+		remote := *u
+		if *gitRemote != "" {
+			r, err := url.Parse(*gitRemote)
+			if err != nil {
+				log.Fatalf("url.Parse: %v", err)
+			}
+			remote = *r
+		}
+		mirror := gerrit.NewGitMirror(*gitMirror, remote)
+		mirror.Fallback = g
+		gc.source = mirror
+	}
+
+	languageCaps, err := parseCaps(*languageWorkers)
+	if err != nil {
+		log.Fatalf("--language_workers: %v", err)
+	}
+	for l := range languageCaps {
+		if !linter.IsSupported(l) {
+			log.Fatalf("--language_workers: language %q is not supported. Choices are %s", l, linter.SupportedLanguages())
+		}
+	}
+	repoCaps, err := parseCaps(*repoWorkers)
+	if err != nil {
+		log.Fatalf("--repo_workers: %v", err)
+	}
+	gc.pool = newWorkerPool(*workers, languageCaps, repoCaps)
+	gc.queue = newWorkQueue(*queueSize)
+	expvar.Publish("queue", gc.queue.metrics)
+
+	if *languages != "" {
+		for _, l := range strings.Split(*languages, ",") {
+			if !linter.IsSupported(l) {
+				log.Fatalf("language %q is not supported. Choices are %s", l, linter.SupportedLanguages())
+			}
+			gc.languages = append(gc.languages, l)
+		}
+	}
+
+	// With webhooks, polling is only a safety net for lost events.
+	pollSet := false
+	flag.Visit(func(f *flag.Flag) {
+		pollSet = pollSet || f.Name == "poll_interval"
+	})
+	if *httpAddr != "" && !pollSet {
+		*pollInterval = 5 * time.Minute
+	}
+
+	gc.sources = nil
+	for _, name := range strings.Split(*sources, ",") {
+		switch name {
+		case "pending":
+			gc.sources = append(gc.sources, &pendingSource{server: g, interval: *pollInterval})
+		case "query":
+			gc.sources = append(gc.sources, &querySource{
+				server:   g,
+				query:    *query,
+				interval: *pollInterval,
+				pending:  gc.pendingFor,
+			})
+		case "":
+		default:
+			log.Fatalf("unknown source %q", name)
+		}
+	}
+	webhookSecret, err := readSecret(*webhookSecretFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// listeners are started after the one-shot commands below, so
+	// these don't take the ports.
+	var listeners []*http.Server
+	if *httpAddr != "" {
+		webhook := newWebhookSource(gc.pendingFor, webhookSecret)
+		webhook.recheck, err = regexp.Compile(*recheck)
+		if err != nil {
+			log.Fatalf("--recheck_pattern: %v", err)
+		}
+		gc.sources = append(gc.sources, webhook)
+
+		mux := http.NewServeMux()
+		mux.Handle("/webhook", webhook)
+		listeners = append(listeners, &http.Server{Addr: *httpAddr, Handler: mux})
+	}
+	if *adminAddr != "" {
+		enqueueSecret := webhookSecret
+		if *enqueueSecretFile != "" {
+			enqueueSecret, err = readSecret(*enqueueSecretFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if enqueueSecret == "" {
+			log.Fatal("--admin_http needs --enqueue_secret_file or --webhook_secret_file")
+		}
+		manual := &manualSource{newHTTPSource(gc.pendingFor), enqueueSecret}
+		gc.sources = append(gc.sources, manual)
+
+		mux := http.NewServeMux()
+		mux.Handle("/enqueue", manual)
+		mux.Handle("/debug/vars", expvar.Handler())
+		listeners = append(listeners, &http.Server{Addr: *adminAddr, Handler: mux})
+	}
+
 	if *list {
 		if out, err := gc.ListCheckers(); err != nil {
 			log.Fatalf("List: %v", err)
@@ -115,5 +432,10 @@ func main() {
 		os.Exit(0)
 	}
 
-	gc.Serve()
+	for _, l := range listeners {
+		go func(l *http.Server) {
+			log.Fatal(l.ListenAndServe())
+		}(l)
+	}
+	gc.Serve(context.Background())
 }
@@ -0,0 +1,47 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []string
+	}{
+		{"helper get", []string{"helper", "get"}},
+		{"  helper   get ", []string{"helper", "get"}},
+		{`["/opt/My Helper/helper", "get"]`, []string{"/opt/My Helper/helper", "get"}},
+		{` ["a b"]`, []string{"a b"}},
+		{"", nil},
+		{"[]", nil},
+		{`[""]`, nil},
+		{`["unterminated`, nil},
+	} {
+		got, err := parseCommand(tc.in)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("parseCommand(%q): got %q, want error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseCommand(%q): got %q, %v, want %q", tc.in, got, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 Google Ltd. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// workerPool limits the number of checks that run concurrently, in
+// total, per language and per repository.
+type workerPool struct {
+	workers   int
+	global    chan struct{}
+	languages map[string]chan struct{}
+
+	// repos holds the per-repository limits. Repositories without an
+	// entry are limited by repoDefault, if positive.
+	mu          sync.Mutex
+	repos       map[string]chan struct{}
+	repoDefault int
+}
+
+// newWorkerPool creates a pool of workers. The language and repo caps
+// map names to limits; the "*" repo entry applies to all repositories
+// without their own entry.
+func newWorkerPool(workers int, languageCaps, repoCaps map[string]int) *workerPool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &workerPool{
+		workers:     workers,
+		global:      make(chan struct{}, workers),
+		languages:   map[string]chan struct{}{},
+		repos:       map[string]chan struct{}{},
+		repoDefault: repoCaps["*"],
+	}
+	for l, n := range languageCaps {
+		p.languages[l] = make(chan struct{}, n)
+	}
+	for r, n := range repoCaps {
+		if r != "*" {
+			p.repos[r] = make(chan struct{}, n)
+		}
+	}
+	return p
+}
+
+// repoSlots returns the semaphore for a repository, or nil if it is
+// not limited.
+func (p *workerPool) repoSlots(repo string) chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s, ok := p.repos[repo]; ok {
+		return s
+	}
+	if p.repoDefault <= 0 {
+		return nil
+	}
+	s := make(chan struct{}, p.repoDefault)
+	p.repos[repo] = s
+	return s
+}
+
+// acquire waits until a check for the language on the repository may
+// run. The specific limits are taken before the global one, so checks
+// waiting for a busy language don't hold up the others.
+func (p *workerPool) acquire(ctx context.Context, repo, language string) (release func(), err error) {
+	var held []chan struct{}
+	release = func() {
+		for _, s := range held {
+			<-s
+		}
+	}
+
+	for _, s := range []chan struct{}{p.languages[language], p.repoSlots(repo), p.global} {
+		if s == nil {
+			continue
+		}
+		select {
+		case s <- struct{}{}:
+			held = append(held, s)
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+	}
+	return release, nil
+}
+
+// parseCaps parses limits of the form "NAME=N,NAME=N".
+func parseCaps(spec string) (map[string]int, error) {
+	caps := map[string]int{}
+	if spec == "" {
+		return caps, nil
+	}
+	for _, field := range strings.Split(spec, ",") {
+		idx := strings.Index(field, "=")
+		if idx < 0 {
+			return nil, fmt.Errorf("%q: want NAME=N", field)
+		}
+		n, err := strconv.Atoi(field[idx+1:])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("%q: want a positive limit", field)
+		}
+		caps[strings.TrimSpace(field[:idx])] = n
+	}
+	return caps, nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCaps(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want map[string]int
+		ok   bool
+	}{
+		{"", map[string]int{}, true},
+		{"go=2", map[string]int{"go": 2}, true},
+		{"go=2, java=1", map[string]int{"go": 2, "java": 1}, true},
+		{"*=1,big=4", map[string]int{"*": 1, "big": 4}, true},
+		{"go", nil, false},
+		{"go=0", nil, false},
+		{"go=-1", nil, false},
+		{"go=x", nil, false},
+		{"go=2,", nil, false},
+	} {
+		got, err := parseCaps(tc.in)
+		if (err == nil) != tc.ok {
+			t.Errorf("parseCaps(%q): got error %v, want ok %v", tc.in, err, tc.ok)
+			continue
+		}
+		if tc.ok && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseCaps(%q): got %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+// tryAcquire acquires a slot, giving up quickly if it blocks.
+func tryAcquire(p *workerPool, repo, language string) (func(), error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	return p.acquire(ctx, repo, language)
+}
+
+func TestWorkerPoolLanguages(t *testing.T) {
+	p := newWorkerPool(3, map[string]int{"go": 1}, nil)
+
+	releaseGo, err := tryAcquire(p, "r", "go")
+	if err != nil {
+		t.Fatalf("acquire go: %v", err)
+	}
+	if _, err := tryAcquire(p, "r", "go"); err != context.DeadlineExceeded {
+		t.Errorf("acquire go while busy: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	// A saturated language doesn't hold global slots, or block other
+	// languages.
+	if got := len(p.global); got != 1 {
+		t.Errorf("global slots in use: got %d, want 1", got)
+	}
+	releaseJava, err := tryAcquire(p, "r", "java")
+	if err != nil {
+		t.Fatalf("acquire java while go is busy: %v", err)
+	}
+	releaseJava2, err := tryAcquire(p, "r", "java")
+	if err != nil {
+		t.Fatalf("acquire uncapped java: %v", err)
+	}
+	// The global limit still applies.
+	if _, err := tryAcquire(p, "r", "java"); err == nil {
+		t.Errorf("acquire beyond the global limit: got nil error")
+	}
+
+	releaseGo()
+	releaseJava()
+	releaseJava2()
+	if _, err := tryAcquire(p, "r", "go"); err != nil {
+		t.Errorf("acquire go after release: %v", err)
+	}
+}
+
+func TestWorkerPoolCancel(t *testing.T) {
+	p := newWorkerPool(1, map[string]int{"go": 2}, nil)
+	release, err := tryAcquire(p, "r", "go")
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+
+	// The second check gets a language slot, then waits for the
+	// global one until it is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := p.acquire(ctx, "r", "go")
+		done <- err
+	}()
+	for len(p.languages["go"]) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("acquire: got %v, want %v", err, context.Canceled)
+	}
+	if got := len(p.languages["go"]); got != 1 {
+		t.Errorf("language slots after cancel: got %d, want 1", got)
+	}
+
+	release()
+	if got := len(p.languages["go"]) + len(p.global); got != 0 {
+		t.Errorf("slots after release: got %d, want 0", got)
+	}
+}
+
+func TestWorkerPoolRepos(t *testing.T) {
+	p := newWorkerPool(10, nil, map[string]int{"*": 1, "big": 2})
+
+	for _, tc := range []struct {
+		repo string
+		ok   bool
+	}{
+		// "*" applies to each repository separately.
+		{"r1", true},
+		{"r1", false},
+		{"r2", true},
+		// Repositories with their own limit don't use the default.
+		{"big", true},
+		{"big", true},
+		{"big", false},
+	} {
+		_, err := tryAcquire(p, tc.repo, "go")
+		if (err == nil) != tc.ok {
+			t.Errorf("acquire %s: got error %v, want ok %v", tc.repo, err, tc.ok)
+		}
+	}
+
+	p = newWorkerPool(10, nil, map[string]int{"big": 1})
+	for i := 0; i < 3; i++ {
+		if _, err := tryAcquire(p, "r", "go"); err != nil {
+			t.Errorf("acquire %d without a repository limit: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2020 Google Ltd. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/gerrit-linter/gerrit"
+)
+
+// checkKey identifies a check on a patchset.
+type checkKey struct {
+	patchSet string
+	checker  string
+}
+
+// patchSetKey returns a key for a patchset, as "project~number/patchset".
+func patchSetKey(ps *gerrit.CheckablePatchSetInfo) string {
+	return fmt.Sprintf("%s/%d", sourceChangeID(ps), ps.PatchSetID)
+}
+
+// queueItem is a queued patchset.
+type queueItem struct {
+	pc     *gerrit.PendingChecksInfo
+	queued time.Time
+}
+
+// workQueue is a bounded FIFO of patchsets to check. A check is not
+// added again while it is queued or running, and checks for a patchset
+// that is already queued are merged into its entry. When the queue is
+// full, push blocks.
+type workQueue struct {
+	capacity int
+
+	mu    sync.Mutex
+	items []*queueItem
+
+	// queued maps patchset keys to their entry in items.
+	queued map[string]*queueItem
+
+	// inFlight holds the checks that are queued or running.
+	inFlight map[checkKey]bool
+
+	// changed is closed and replaced whenever items changes, to wake
+	// up waiters.
+	changed chan struct{}
+
+	// metrics holds the queue statistics, for expvar.
+	metrics    *expvar.Map
+	depth      expvar.Int
+	running    expvar.Int
+	enqueued   expvar.Int
+	merged     expvar.Int
+	duplicates expvar.Int
+	dequeued   expvar.Int
+	waitTotal  expvar.Float
+	waitMax    expvar.Float
+}
+
+// newWorkQueue creates a queue holding up to capacity patchsets.
+func newWorkQueue(capacity int) *workQueue {
+	if capacity < 1 {
+		capacity = 1
+	}
+	q := &workQueue{
+		capacity: capacity,
+		queued:   map[string]*queueItem{},
+		inFlight: map[checkKey]bool{},
+		changed:  make(chan struct{}),
+		metrics:  new(expvar.Map).Init(),
+	}
+	q.metrics.Set("depth", &q.depth)
+	q.metrics.Set("in_flight_checks", &q.running)
+	q.metrics.Set("enqueued", &q.enqueued)
+	q.metrics.Set("merged", &q.merged)
+	q.metrics.Set("duplicate_checks", &q.duplicates)
+	q.metrics.Set("dequeued", &q.dequeued)
+	q.metrics.Set("wait_seconds_total", &q.waitTotal)
+	q.metrics.Set("wait_seconds_max", &q.waitMax)
+	return q
+}
+
+// notify wakes up waiters. It must be called with mu held.
+func (q *workQueue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+	q.depth.Set(int64(len(q.items)))
+	q.running.Set(int64(len(q.inFlight)))
+}
+
+// push adds the checks of a patchset that aren't queued or running
+// yet. It blocks while the queue is full.
+func (q *workQueue) push(ctx context.Context, pc *gerrit.PendingChecksInfo) error {
+	key := patchSetKey(pc.PatchSet)
+	for {
+		q.mu.Lock()
+		fresh := map[string]*gerrit.PendingCheckInfo{}
+		for uuid, info := range pc.PendingChecks {
+			if q.inFlight[checkKey{key, uuid}] {
+				q.duplicates.Add(1)
+				continue
+			}
+			fresh[uuid] = info
+		}
+
+		if len(fresh) == 0 {
+			q.mu.Unlock()
+			return nil
+		}
+
+		if item, ok := q.queued[key]; ok {
+			for uuid, info := range fresh {
+				item.pc.PendingChecks[uuid] = info
+				q.inFlight[checkKey{key, uuid}] = true
+			}
+			q.merged.Add(1)
+			q.notify()
+			q.mu.Unlock()
+			return nil
+		}
+
+		if len(q.items) < q.capacity {
+			item := &queueItem{
+				pc: &gerrit.PendingChecksInfo{
+					PatchSet:      pc.PatchSet,
+					PendingChecks: fresh,
+				},
+				queued: time.Now(),
+			}
+			for uuid := range fresh {
+				q.inFlight[checkKey{key, uuid}] = true
+			}
+			q.items = append(q.items, item)
+			q.queued[key] = item
+			q.enqueued.Add(1)
+			q.notify()
+			q.mu.Unlock()
+			return nil
+		}
+
+		changed := q.changed
+		q.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// pop removes the oldest patchset, waiting until there is one. Its
+// checks remain in flight until done is called.
+func (q *workQueue) pop(ctx context.Context) (*gerrit.PendingChecksInfo, error) {
+	for {
+		q.mu.Lock()
+		if len(q.items) > 0 {
+			item := q.items[0]
+			q.items[0] = nil
+			q.items = q.items[1:]
+			delete(q.queued, patchSetKey(item.pc.PatchSet))
+
+			wait := time.Since(item.queued).Seconds()
+			q.dequeued.Add(1)
+			q.waitTotal.Add(wait)
+			if wait > q.waitMax.Value() {
+				q.waitMax.Set(wait)
+			}
+			q.notify()
+			q.mu.Unlock()
+			return item.pc, nil
+		}
+
+		changed := q.changed
+		q.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// done marks the checks of a popped patchset as finished.
+func (q *workQueue) done(pc *gerrit.PendingChecksInfo) {
+	key := patchSetKey(pc.PatchSet)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for uuid := range pc.PendingChecks {
+		delete(q.inFlight, checkKey{key, uuid})
+	}
+	q.notify()
+}
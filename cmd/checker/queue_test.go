@@ -0,0 +1,167 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/gerrit-linter/gerrit"
+)
+
+// pendingChecks returns pending checks for a patchset of change 1 in
+// repository "r".
+func pendingChecks(patchSet int, uuids ...string) *gerrit.PendingChecksInfo {
+	pc := &gerrit.PendingChecksInfo{
+		PatchSet: &gerrit.CheckablePatchSetInfo{
+			Repository:   "r",
+			ChangeNumber: 1,
+			PatchSetID:   patchSet,
+		},
+		PendingChecks: map[string]*gerrit.PendingCheckInfo{},
+	}
+	for _, uuid := range uuids {
+		pc.PendingChecks[uuid] = &gerrit.PendingCheckInfo{State: gerrit.StateNotStarted}
+	}
+	return pc
+}
+
+// popChecks pops a patchset, and returns its key and checkers.
+func popChecks(t *testing.T, q *workQueue) (string, []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	pc, err := q.pop(ctx)
+	if err != nil {
+		t.Fatalf("pop: %v", err)
+	}
+	var uuids []string
+	for uuid := range pc.PendingChecks {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	return patchSetKey(pc.PatchSet), uuids
+}
+
+func TestWorkQueueMerge(t *testing.T) {
+	q := newWorkQueue(10)
+	ctx := context.Background()
+	for _, pc := range []*gerrit.PendingChecksInfo{
+		pendingChecks(1, "fmt:a"),
+		pendingChecks(2, "fmt:a"),
+		// New checkers are merged into the queued patchset.
+		pendingChecks(1, "fmt:a", "fmt:b"),
+	} {
+		if err := q.push(ctx, pc); err != nil {
+			t.Fatalf("push: %v", err)
+		}
+	}
+	if got := len(q.items); got != 2 {
+		t.Errorf("queue holds %d patchsets, want 2", got)
+	}
+	if got := q.merged.Value(); got != 1 {
+		t.Errorf("merged: got %d, want 1", got)
+	}
+
+	key, uuids := popChecks(t, q)
+	if want := []string{"fmt:a", "fmt:b"}; key != "r~1/1" || !reflect.DeepEqual(uuids, want) {
+		t.Errorf("pop: got %s %v, want r~1/1 %v", key, uuids, want)
+	}
+	key, uuids = popChecks(t, q)
+	if want := []string{"fmt:a"}; key != "r~1/2" || !reflect.DeepEqual(uuids, want) {
+		t.Errorf("pop: got %s %v, want r~1/2 %v", key, uuids, want)
+	}
+}
+
+func TestWorkQueueInFlight(t *testing.T) {
+	q := newWorkQueue(10)
+	ctx := context.Background()
+	if err := q.push(ctx, pendingChecks(1, "fmt:a")); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	_, _ = popChecks(t, q)
+
+	// The check is running, so it isn't queued again, but other
+	// checkers for the patchset are.
+	if err := q.push(ctx, pendingChecks(1, "fmt:a")); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if got := len(q.items); got != 0 {
+		t.Errorf("queued a running check: %d patchsets queued", got)
+	}
+	if got := q.duplicates.Value(); got != 1 {
+		t.Errorf("duplicates: got %d, want 1", got)
+	}
+	if err := q.push(ctx, pendingChecks(1, "fmt:a", "fmt:b")); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	_, uuids := popChecks(t, q)
+	if want := []string{"fmt:b"}; !reflect.DeepEqual(uuids, want) {
+		t.Errorf("pop: got %v, want %v", uuids, want)
+	}
+
+	// Once it is done, it can be queued again.
+	q.done(pendingChecks(1, "fmt:a"))
+	if err := q.push(ctx, pendingChecks(1, "fmt:a")); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	_, uuids = popChecks(t, q)
+	if want := []string{"fmt:a"}; !reflect.DeepEqual(uuids, want) {
+		t.Errorf("pop after done: got %v, want %v", uuids, want)
+	}
+}
+
+func TestWorkQueueFull(t *testing.T) {
+	q := newWorkQueue(1)
+	if err := q.push(context.Background(), pendingChecks(1, "fmt:a")); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+
+	// Merging into a queued patchset doesn't need room.
+	if err := q.push(context.Background(), pendingChecks(1, "fmt:b")); err != nil {
+		t.Fatalf("push to the queued patchset: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- q.push(ctx, pendingChecks(2, "fmt:a"))
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("push to a full queue returned %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("push: got %v, want %v", err, context.Canceled)
+	}
+
+	// A blocked push proceeds once there is room.
+	go func() {
+		done <- q.push(context.Background(), pendingChecks(2, "fmt:a"))
+	}()
+	if key, _ := popChecks(t, q); key != "r~1/1" {
+		t.Errorf("pop: got %s, want r~1/1", key)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if key, _ := popChecks(t, q); key != "r~1/2" {
+		t.Errorf("pop: got %s, want r~1/2", key)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2020 Google Ltd. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/gerrit-linter/gerrit"
+)
+
+// defaultTokenEndpoint is the Google OAuth2 token endpoint, used if
+// the key doesn't name one.
+const defaultTokenEndpoint = "https://oauth2.googleapis.com/token"
+
+// jwtBearerGrant is the OAuth2 grant type for JWT assertions (RFC 7523).
+const jwtBearerGrant = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+
+// serviceAccountKey is a Google service account JSON key file.
+type serviceAccountKey struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// keySigner exchanges signed JWT assertions for access tokens.
+type keySigner struct {
+	email    string
+	keyID    string
+	key      *rsa.PrivateKey
+	endpoint string
+	client   *http.Client
+}
+
+// parsePrivateKey parses a PEM encoded RSA key, in PKCS#8 or PKCS#1
+// form.
+func parsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in private key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is %T, want RSA", parsed)
+	}
+	return key, nil
+}
+
+// assertion returns a signed JWT asking for the Gerrit scope.
+func (s *keySigner) assertion(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": s.keyID,
+	})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   s.email,
+		"scope": gerritScope,
+		"aud":   s.endpoint,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
+
+// fetchToken exchanges a fresh assertion for an access token.
+func (s *keySigner) fetchToken() (*gcpToken, error) {
+	now := time.Now()
+	jwt, err := s.assertion(now)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type": {jwtBearerGrant},
+		"assertion":  {jwt},
+	}
+	resp, err := s.client.Post(s.endpoint, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	all, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("POST %s failed (%d): %s", s.endpoint, resp.StatusCode, string(all))
+	}
+	return parseToken(all, now)
+}
+
+// NewServiceAccountKey returns an Authenticator that uses a service
+// account JSON key file to get bearer tokens with the Gerrit scope.
+// The tokens are refreshed automatically. If endpoint is empty, the
+// token_uri of the key is used.
+func NewServiceAccountKey(keyFile, endpoint string) (gerrit.Authenticator, error) {
+	content, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	var k serviceAccountKey
+	if err := json.Unmarshal(content, &k); err != nil {
+		return nil, fmt.Errorf("%s: %v", keyFile, err)
+	}
+	if k.Type != "service_account" {
+		return nil, fmt.Errorf("%s: got key type %q, want service_account", keyFile, k.Type)
+	}
+	key, err := parsePrivateKey([]byte(k.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", keyFile, err)
+	}
+
+	if endpoint == "" {
+		endpoint = k.TokenURI
+	}
+	if endpoint == "" {
+		endpoint = defaultTokenEndpoint
+	}
+
+	s := &keySigner{
+		email:    k.ClientEmail,
+		keyID:    k.PrivateKeyID,
+		key:      key,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+	return newTokenCache(s.fetchToken)
+}
@@ -0,0 +1,203 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// verifyAssertion checks the header, claims and signature of a JWT
+// assertion signed by key.
+func verifyAssertion(t *testing.T, jwt string, key *rsa.PublicKey, endpoint string, now time.Time) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		t.Fatalf("assertion has %d parts, want 3", len(parts))
+	}
+	enc := base64.RawURLEncoding
+	decode := func(s string, v interface{}) {
+		data, err := enc.DecodeString(s)
+		if err != nil {
+			t.Fatalf("decode %q: %v", s, err)
+		}
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Fatalf("Unmarshal(%s): %v", data, err)
+		}
+	}
+
+	var header map[string]string
+	decode(parts[0], &header)
+	if header["alg"] != "RS256" || header["typ"] != "JWT" || header["kid"] != "key-1" {
+		t.Errorf("header: got %v", header)
+	}
+
+	var claims struct {
+		Iss   string `json:"iss"`
+		Scope string `json:"scope"`
+		Aud   string `json:"aud"`
+		Iat   int64  `json:"iat"`
+		Exp   int64  `json:"exp"`
+	}
+	decode(parts[1], &claims)
+	if claims.Iss != "sa@example.iam.gserviceaccount.com" {
+		t.Errorf("iss: got %q", claims.Iss)
+	}
+	if claims.Scope != gerritScope {
+		t.Errorf("scope: got %q, want %q", claims.Scope, gerritScope)
+	}
+	if claims.Aud != endpoint {
+		t.Errorf("aud: got %q, want %q", claims.Aud, endpoint)
+	}
+	if claims.Exp-claims.Iat != 3600 {
+		t.Errorf("exp - iat: got %d, want 3600", claims.Exp-claims.Iat)
+	}
+	if d := time.Unix(claims.Iat, 0).Sub(now); d < -time.Minute || d > time.Minute {
+		t.Errorf("iat: got %v, want about %v", time.Unix(claims.Iat, 0), now)
+	}
+
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil {
+		t.Fatalf("decode signature: %v", err)
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		t.Errorf("VerifyPKCS1v15: %v", err)
+	}
+}
+
+func TestServiceAccountKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var issued int
+	var endpoint string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/token" {
+			http.NotFound(w, r)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if got := r.PostForm.Get("grant_type"); got != jwtBearerGrant {
+			t.Errorf("grant_type: got %q, want %q", got, jwtBearerGrant)
+		}
+		verifyAssertion(t, r.PostForm.Get("assertion"), &key.PublicKey, endpoint, time.Now())
+		issued++
+		fmt.Fprintf(w, `{"access_token":"t%d","expires_in":3600,"token_type":"Bearer"}`, issued)
+	}))
+	defer ts.Close()
+	endpoint = ts.URL + "/token"
+
+	dir, err := ioutil.TempDir("", "serviceaccount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "key.json")
+	content, err := json.Marshal(serviceAccountKey{
+		Type:         "service_account",
+		ClientEmail:  "sa@example.iam.gserviceaccount.com",
+		PrivateKeyID: "key-1",
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})),
+		TokenURI:     endpoint,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := NewServiceAccountKey(keyFile, "")
+	if err != nil {
+		t.Fatalf("NewServiceAccountKey: %v", err)
+	}
+	tc := auth.(*tokenCache)
+	if got, err := authorization(t, tc); err != nil || got != "Bearer t1" {
+		t.Errorf("Authenticate: got %q, %v, want Bearer t1", got, err)
+	}
+	tc.Invalidate()
+	if got, err := authorization(t, tc); err != nil || got != "Bearer t2" {
+		t.Errorf("Authenticate after Invalidate: got %q, %v, want Bearer t2", got, err)
+	}
+
+	// Only service account keys are accepted.
+	if err := ioutil.WriteFile(keyFile, []byte(`{"type":"authorized_user"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewServiceAccountKey(keyFile, ""); err == nil {
+		t.Errorf("NewServiceAccountKey(authorized_user): got nil error")
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"PKCS#1", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), true},
+		{"PKCS#8", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), true},
+		{"not PEM", []byte("-----BEGIN nothing"), false},
+		{"garbage", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("garbage")}), false},
+	} {
+		got, err := parsePrivateKey(tc.data)
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("%s: got nil error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got.N.Cmp(key.N) != 0 || got.D.Cmp(key.D) != 0 {
+			t.Errorf("%s: got a different key", tc.name)
+		}
+	}
+}
@@ -0,0 +1,567 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gerrit-linter/gerrit"
+)
+
+// fileResult describes a file that failed a check.
+type fileResult struct {
+	Name    string `json:"name"`
+	Message string `json:"message"`
+
+	// Original is the content of the file in the patchset.
+	Original []byte `json:"-"`
+
+	// Formatted is the content after formatting. It is nil if the
+	// formatter only complained.
+	Formatted []byte `json:"-"`
+}
+
+// checkResult is the outcome of running a checker on a patchset.
+type checkResult struct {
+	PatchSet    *gerrit.CheckablePatchSetInfo `json:"patch_set"`
+	CheckerUUID string                        `json:"checker_uuid"`
+	Language    string                        `json:"language"`
+	Status      gerrit.CheckState             `json:"state"`
+	Message     string                        `json:"message"`
+	Started     time.Time                     `json:"started"`
+	Finished    time.Time                     `json:"finished"`
+	Files       []fileResult                  `json:"files,omitempty"`
+
+	// ToolFailure is set if the check failed because the
+	// formatter could not run, rather than because of the files.
+	ToolFailure bool `json:"tool_failure,omitempty"`
+}
+
+// toolFailurePrefix starts the message of a check that failed because
+// the formatter could not run.
+const toolFailurePrefix = "tool failure: "
+
+// transition moves the check to the next state.
+func (r *checkResult) transition(next gerrit.CheckState) error {
+	s, err := r.Status.Transition(next)
+	if err != nil {
+		return fmt.Errorf("%s on %v: %v", r.CheckerUUID, r.PatchSet, err)
+	}
+	r.Status = s
+	return nil
+}
+
+// resultSink reports the outcome of checks.
+type resultSink interface {
+	// Start is called when a check starts running.
+	Start(ctx context.Context, r *checkResult) error
+
+	// Finish is called with the outcome of a single check.
+	Finish(ctx context.Context, r *checkResult) error
+
+	// FinishPatchSet is called once all the checks on a patchset
+	// have finished.
+	FinishPatchSet(ctx context.Context, ps *gerrit.CheckablePatchSetInfo, results []*checkResult) error
+}
+
+// checksSink posts results to the Gerrit checks plugin.
+type checksSink struct {
+	server *gerrit.Server
+}
+
+func (s *checksSink) Start(ctx context.Context, r *checkResult) error {
+	started := gerrit.Timestamp(r.Started)
+	checkInput := gerrit.CheckInput{
+		CheckerUUID: r.CheckerUUID,
+		State:       r.Status,
+		Started:     &started,
+	}
+	log.Printf("posted %s", &checkInput)
+	_, err := s.server.PostCheckContext(ctx, strconv.Itoa(r.PatchSet.ChangeNumber),
+		r.PatchSet.PatchSetID, &checkInput)
+	return err
+}
+
+func (s *checksSink) Finish(ctx context.Context, r *checkResult) error {
+	msg := r.Message
+	if len(msg) > 1000 {
+		msg = msg[:995] + "..."
+	}
+	started := gerrit.Timestamp(r.Started)
+	finished := gerrit.Timestamp(r.Finished)
+	checkInput := gerrit.CheckInput{
+		CheckerUUID: r.CheckerUUID,
+		State:       r.Status,
+		Message:     msg,
+		Started:     &started,
+		Finished:    &finished,
+	}
+	log.Printf("posted %s", &checkInput)
+	_, err := s.server.PostCheckContext(ctx, strconv.Itoa(r.PatchSet.ChangeNumber),
+		r.PatchSet.PatchSetID, &checkInput)
+	return err
+}
+
+func (s *checksSink) FinishPatchSet(ctx context.Context, ps *gerrit.CheckablePatchSetInfo, results []*checkResult) error {
+	return nil
+}
+
+// reviewTag marks the messages posted by the checker, so the Gerrit
+// UI can hide them.
+const reviewTag = "autogenerated:gerrit-linter"
+
+// robotID identifies the checker in robot comments.
+const robotID = "gerrit-linter"
+
+// labelSink votes on a label, and posts a summary message, once all
+// checks on a patchset have finished.
+type labelSink struct {
+	server *gerrit.Server
+	label  string
+}
+
+func (s *labelSink) Start(ctx context.Context, r *checkResult) error {
+	return nil
+}
+
+func (s *labelSink) Finish(ctx context.Context, r *checkResult) error {
+	return nil
+}
+
+// labelVote returns -1 if a check found badly formatted files, +1 if
+// all checks passed or were not relevant, and 0 otherwise. A tool
+// failure says nothing about the change, so it prevents a +1 but
+// doesn't cause a -1, as do checks that haven't finished.
+func labelVote(results []*checkResult) int {
+	passed := false
+	unknown := false
+	for _, r := range results {
+		switch {
+		case r.ToolFailure || !r.Status.IsTerminal():
+			unknown = true
+		case r.Status == gerrit.StateFailed:
+			return -1
+		case r.Status == gerrit.StateSuccessful:
+			passed = true
+		}
+	}
+	if passed && !unknown {
+		return 1
+	}
+	return 0
+}
+
+// allResults adds the current state of the other checks by this
+// checker on the patchset to results, so that rerunning some of them
+// doesn't decide the vote alone. Without the checks plugin, all the
+// languages run together, and results is returned as is.
+func (s *labelSink) allResults(ctx context.Context, ps *gerrit.CheckablePatchSetInfo, results []*checkResult) ([]*checkResult, error) {
+	checks, err := s.server.ListChecks(ctx, sourceChangeID(ps), ps.PatchSetID, nil)
+	if gerrit.IsNotFound(err) {
+		return results, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ran := map[string]bool{}
+	for _, r := range results {
+		ran[r.CheckerUUID] = true
+	}
+	all := append([]*checkResult{}, results...)
+	for _, c := range checks {
+		lang, ok := checkerLanguage(c.CheckerUUID)
+		if !ok || !strings.HasPrefix(c.CheckerUUID, checkerScheme+":") || ran[c.CheckerUUID] {
+			continue
+		}
+		all = append(all, &checkResult{
+			PatchSet:    ps,
+			CheckerUUID: c.CheckerUUID,
+			Language:    lang,
+			Status:      c.State,
+			Message:     c.Message,
+			ToolFailure: c.State == gerrit.StateFailed && strings.HasPrefix(c.Message, toolFailurePrefix),
+		})
+	}
+	return all, nil
+}
+
+func (s *labelSink) FinishPatchSet(ctx context.Context, ps *gerrit.CheckablePatchSetInfo, results []*checkResult) error {
+	results, err := s.allResults(ctx, ps, results)
+	if err != nil {
+		return err
+	}
+	sorted := append([]*checkResult{}, results...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Language < sorted[j].Language })
+
+	var lines []string
+	for _, r := range sorted {
+		line := fmt.Sprintf("%s: %s", r.Language, r.Status)
+		if r.Message != "" {
+			line += "\n  " + r.Message
+		}
+		lines = append(lines, line)
+	}
+
+	in := gerrit.ReviewInput{
+		Message: "Formatting\n\n" + strings.Join(lines, "\n"),
+		Tag:     reviewTag,
+		Labels:  map[string]int{s.label: labelVote(results)},
+		Notify:  "NONE",
+	}
+	log.Printf("review %s", &in)
+	_, err = s.server.SetReview(ctx, sourceChangeID(ps), strconv.Itoa(ps.PatchSetID), &in)
+	return err
+}
+
+// commentSink posts the failures on a patchset as robot comments on
+// the changed hunks, with the formatted lines as suggested fixes.
+type commentSink struct {
+	server *gerrit.Server
+}
+
+func (s *commentSink) Start(ctx context.Context, r *checkResult) error {
+	return nil
+}
+
+func (s *commentSink) Finish(ctx context.Context, r *checkResult) error {
+	return nil
+}
+
+// maxDiffCells bounds the table that diffLines fills. Past it, the
+// lines between the common prefix and suffix form a single hunk.
+const maxDiffCells = 1 << 22
+
+// lineHunk replaces lines [start, end) of the original content, counted
+// from 0, with lines.
+type lineHunk struct {
+	start, end int
+	lines      []string
+}
+
+// splitLines splits content into lines, keeping their newlines.
+func splitLines(content []byte) []string {
+	if len(content) == 0 {
+		return nil
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns the hunks that turn a into b, based on their
+// longest common subsequence.
+func diffLines(a, b []string) []lineHunk {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	a, b = a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+	if len(a)*len(b) > maxDiffCells {
+		return []lineHunk{{prefix, prefix + len(a), b}}
+	}
+
+	// common[i][j] is the length of the longest common subsequence
+	// of a[i:] and b[j:].
+	common := make([][]int, len(a)+1)
+	for i := range common {
+		common[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else if common[i+1][j] >= common[i][j+1] {
+				common[i][j] = common[i+1][j]
+			} else {
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+
+	var hunks []lineHunk
+	i, j := 0, 0
+	hi, hj := -1, -1
+	flush := func() {
+		if hi >= 0 {
+			hunks = append(hunks, lineHunk{prefix + hi, prefix + i, b[hj:j]})
+			hi, hj = -1, -1
+		}
+	}
+	for i < len(a) || j < len(b) {
+		if i < len(a) && j < len(b) && a[i] == b[j] {
+			flush()
+			i++
+			j++
+			continue
+		}
+		if hi < 0 {
+			hi, hj = i, j
+		}
+		if j == len(b) || (i < len(a) && common[i+1][j] >= common[i][j+1]) {
+			i++
+		} else {
+			j++
+		}
+	}
+	flush()
+	return hunks
+}
+
+// hunkFix returns the range in the original lines that a hunk replaces,
+// and its replacement. Ranges stay within the file: a hunk that reaches
+// the end leaves out the final newline, and so does its replacement.
+func hunkFix(orig []string, h lineHunk) (*gerrit.CommentRange, string) {
+	if h.end == len(orig) && h.start > 0 && (h.start == h.end || len(h.lines) == 0) {
+		// The final newline is left out of the range, so appending
+		// or deleting at the end also replaces the line before.
+		h.start--
+		h.lines = append([]string{orig[h.start]}, h.lines...)
+	}
+	repl := strings.Join(h.lines, "")
+	r := &gerrit.CommentRange{StartLine: h.start + 1, EndLine: h.end + 1}
+	if h.end == len(orig) && h.end > 0 {
+		last := orig[h.end-1]
+		r.EndLine = h.end
+		r.EndCharacter = len(strings.TrimSuffix(last, "\n"))
+		if strings.HasSuffix(last, "\n") {
+			repl = strings.TrimSuffix(repl, "\n")
+		}
+	}
+	return r, repl
+}
+
+// hunkComment returns the position of a comment on a hunk: the changed
+// lines, or the line before the insertion point.
+func hunkComment(orig []string, h lineHunk) (int, *gerrit.CommentRange) {
+	if h.end == h.start {
+		if h.start == 0 {
+			return 1, nil
+		}
+		return h.start, nil
+	}
+	return h.end, &gerrit.CommentRange{
+		StartLine:    h.start + 1,
+		EndLine:      h.end,
+		EndCharacter: len(strings.TrimSuffix(orig[h.end-1], "\n")),
+	}
+}
+
+// fileComments returns the comments for a file that failed a check:
+// one per changed hunk, with the formatting of the hunk as a fix, or a
+// file comment if there is no formatted content.
+func fileComments(language, runID string, f fileResult) []*gerrit.RobotCommentInput {
+	newComment := func() *gerrit.RobotCommentInput {
+		return &gerrit.RobotCommentInput{
+			CommentInput: gerrit.CommentInput{
+				Message: fmt.Sprintf("%s formatting: %s", language, f.Message),
+			},
+			RobotID:    robotID,
+			RobotRunID: runID,
+		}
+	}
+	if f.Formatted == nil {
+		return []*gerrit.RobotCommentInput{newComment()}
+	}
+
+	orig := splitLines(f.Original)
+	hunks := diffLines(orig, splitLines(f.Formatted))
+	if len(hunks) == 0 {
+		return []*gerrit.RobotCommentInput{newComment()}
+	}
+	var comments []*gerrit.RobotCommentInput
+	for _, h := range hunks {
+		c := newComment()
+		c.Line, c.Range = hunkComment(orig, h)
+		r, repl := hunkFix(orig, h)
+		c.FixSuggestions = []*gerrit.FixSuggestionInfo{{
+			Description: "Apply " + language + " formatting",
+			Replacements: []*gerrit.FixReplacementInfo{{
+				Path:        f.Name,
+				Range:       r,
+				Replacement: repl,
+			}},
+		}}
+		comments = append(comments, c)
+	}
+	return comments
+}
+
+func (s *commentSink) FinishPatchSet(ctx context.Context, ps *gerrit.CheckablePatchSetInfo, results []*checkResult) error {
+	runID := fmt.Sprintf("%d-%d-%d", ps.ChangeNumber, ps.PatchSetID, time.Now().Unix())
+	comments := map[string][]*gerrit.RobotCommentInput{}
+	for _, r := range results {
+		for _, f := range r.Files {
+			comments[f.Name] = append(comments[f.Name], fileComments(r.Language, runID, f)...)
+		}
+	}
+	if len(comments) == 0 {
+		return nil
+	}
+
+	in := gerrit.ReviewInput{
+		Tag:                   reviewTag,
+		RobotComments:         comments,
+		OmitDuplicateComments: true,
+		Notify:                "NONE",
+	}
+	_, err := s.server.SetReview(ctx, sourceChangeID(ps), strconv.Itoa(ps.PatchSetID), &in)
+	return err
+}
+
+// jsonSink writes each result as a line of JSON.
+type jsonSink struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func (s *jsonSink) Start(ctx context.Context, r *checkResult) error {
+	return nil
+}
+
+func (s *jsonSink) Finish(ctx context.Context, r *checkResult) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.out.Write(append(line, '\n'))
+	return err
+}
+
+func (s *jsonSink) FinishPatchSet(ctx context.Context, ps *gerrit.CheckablePatchSetInfo, results []*checkResult) error {
+	return nil
+}
+
+// stdoutSink prints results in human-readable form.
+type stdoutSink struct {
+	mu sync.Mutex
+}
+
+func (s *stdoutSink) Start(ctx context.Context, r *checkResult) error {
+	return nil
+}
+
+func (s *stdoutSink) Finish(ctx context.Context, r *checkResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := fmt.Printf("%s %d/%d %s %s %s\n", r.PatchSet.Repository,
+		r.PatchSet.ChangeNumber, r.PatchSet.PatchSetID, r.CheckerUUID, r.Status, r.Message)
+	return err
+}
+
+func (s *stdoutSink) FinishPatchSet(ctx context.Context, ps *gerrit.CheckablePatchSetInfo, results []*checkResult) error {
+	return nil
+}
+
+// sinkOptions holds the settings for constructing sinks.
+type sinkOptions struct {
+	server *gerrit.Server
+
+	// label is the label that labelSink votes on.
+	label string
+
+	// resultsFile is the file that jsonSink appends to.
+	resultsFile string
+}
+
+// newSinks creates sinks from a comma separated list of names. Sinks
+// that write to files are shared through the cache.
+func newSinks(names string, opts *sinkOptions, cache map[string]resultSink) ([]resultSink, error) {
+	var sinks []resultSink
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if s, ok := cache[name]; ok {
+			sinks = append(sinks, s)
+			continue
+		}
+
+		var s resultSink
+		switch name {
+		case "checks":
+			s = &checksSink{server: opts.server}
+		case "label":
+			if opts.label == "" {
+				return nil, fmt.Errorf("sink %q needs a label", name)
+			}
+			s = &labelSink{server: opts.server, label: opts.label}
+		case "comments":
+			s = &commentSink{server: opts.server}
+		case "jsonl":
+			if opts.resultsFile == "" {
+				return nil, fmt.Errorf("sink %q needs a results file", name)
+			}
+			f, err := os.OpenFile(opts.resultsFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				return nil, err
+			}
+			s = &jsonSink{out: f}
+		case "stdout":
+			s = &stdoutSink{}
+		default:
+			return nil, fmt.Errorf("unknown sink %q", name)
+		}
+		cache[name] = s
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
+
+// parseSinks parses sink specifications of the form "REPO=SINK,SINK"
+// or "SINK,SINK". The latter applies to all repositories without
+// their own specification.
+func parseSinks(specs []string, opts *sinkOptions) (map[string][]resultSink, error) {
+	cache := map[string]resultSink{}
+	result := map[string][]resultSink{}
+	for _, spec := range specs {
+		repo, names := "*", spec
+		if idx := strings.Index(spec, "="); idx >= 0 {
+			repo, names = spec[:idx], spec[idx+1:]
+		}
+		sinks, err := newSinks(names, opts, cache)
+		if err != nil {
+			return nil, fmt.Errorf("sink spec %q: %v", spec, err)
+		}
+		result[repo] = sinks
+	}
+	if _, ok := result["*"]; !ok {
+		sinks, err := newSinks("checks", opts, cache)
+		if err != nil {
+			return nil, err
+		}
+		result["*"] = sinks
+	}
+	return result, nil
+}
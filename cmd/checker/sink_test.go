@@ -0,0 +1,191 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/gerrit-linter/gerrit"
+	"github.com/google/gerrit-linter/gerrit/fake"
+)
+
+func TestDiffLines(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want []lineHunk
+	}{
+		{"a\nb\n", "a\nb\n", nil},
+		{"a\nb\nc\n", "a\nB\nc\n", []lineHunk{{1, 2, []string{"B\n"}}}},
+		{"a\nb\nc\nd\n", "A\nb\nc\nD\n", []lineHunk{{0, 1, []string{"A\n"}}, {3, 4, []string{"D\n"}}}},
+		{"a\nc\n", "a\nb\nc\n", []lineHunk{{1, 1, []string{"b\n"}}}},
+		{"a\nb\nc\n", "a\nc\n", []lineHunk{{1, 2, []string{}}}},
+		{"a\nb\n", "a\nb\nc\n", []lineHunk{{2, 2, []string{"c\n"}}}},
+		{"", "a\n", []lineHunk{{0, 0, []string{"a\n"}}}},
+		{"a", "a\n", []lineHunk{{0, 1, []string{"a\n"}}}},
+		{"x\na\nb\ny\n", "x\nb\na\ny\n", []lineHunk{{1, 2, []string{}}, {3, 3, []string{"a\n"}}}},
+	} {
+		got := diffLines(splitLines([]byte(tc.a)), splitLines([]byte(tc.b)))
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("diffLines(%q, %q): got %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+// applyFix replaces a range of content.
+func applyFix(t *testing.T, content string, r *gerrit.CommentRange, repl string) string {
+	offset := func(line, char int) int {
+		lines := strings.SplitAfter(content, "\n")
+		if line < 1 || line > len(lines) || char > len(strings.TrimSuffix(lines[line-1], "\n")) {
+			t.Fatalf("position %d:%d is outside %q", line, char, content)
+		}
+		return len(strings.Join(lines[:line-1], "")) + char
+	}
+	start, end := offset(r.StartLine, r.StartCharacter), offset(r.EndLine, r.EndCharacter)
+	return content[:start] + repl + content[end:]
+}
+
+func TestFileComments(t *testing.T) {
+	for _, tc := range []struct {
+		orig, formatted string
+		lines           []int
+	}{
+		{"a\nb\nc\n", "a\nB\nc\n", []int{2}},
+		{"a\nb\nc\nd\n", "A\nb\nc\nD\n", []int{1, 4}},
+		{"a\nc\n", "a\nb\nc\n", []int{1}},
+		{"a\nb\nc\n", "a\nc\n", []int{2}},
+		{"a\nb\n", "a\nb\nc\n", []int{2}},
+		{"a\nb\nc\n", "a\nb\n", []int{3}},
+		{"a\nb\nc\n", "a\nb\nC\n", []int{3}},
+		{"a\nb", "a\nB\n", []int{2}},
+		{"b\n", "a\nb\n", []int{1}},
+		{"", "a\n", []int{1}},
+	} {
+		f := fileResult{Name: "f.go", Message: "not formatted", Original: []byte(tc.orig), Formatted: []byte(tc.formatted)}
+		comments := fileComments("go", "run", f)
+
+		var lines []int
+		fixed := tc.orig
+		for i := len(comments) - 1; i >= 0; i-- {
+			c := comments[i]
+			lines = append([]int{c.Line}, lines...)
+			if c.Range != nil && c.Range.EndLine != c.Line {
+				t.Errorf("%q: comment on line %d has range ending on line %d", tc.orig, c.Line, c.Range.EndLine)
+			}
+			if len(c.FixSuggestions) != 1 || len(c.FixSuggestions[0].Replacements) != 1 {
+				t.Fatalf("%q: got fixes %v, want one replacement", tc.orig, c.FixSuggestions)
+			}
+			repl := c.FixSuggestions[0].Replacements[0]
+			fixed = applyFix(t, fixed, repl.Range, repl.Replacement)
+		}
+		if !reflect.DeepEqual(lines, tc.lines) {
+			t.Errorf("%q -> %q: comments on lines %v, want %v", tc.orig, tc.formatted, lines, tc.lines)
+		}
+		if fixed != tc.formatted {
+			t.Errorf("%q: applying the fixes gives %q, want %q", tc.orig, fixed, tc.formatted)
+		}
+	}
+
+	// Without formatted content, the file gets a single comment.
+	comments := fileComments("go", "run", fileResult{Name: "f.go", Message: "bad", Original: []byte("a\n")})
+	if len(comments) != 1 || comments[0].Line != 0 || comments[0].FixSuggestions != nil {
+		t.Errorf("fileComments without fix: got %+v", comments)
+	}
+	if got, want := comments[0].Message, "go formatting: bad"; got != want {
+		t.Errorf("message: got %q, want %q", got, want)
+	}
+}
+
+func TestCommentSink(t *testing.T) {
+	fs := fake.New()
+	defer fs.Close()
+	fs.AddPatchSet("repo", 1, 1, map[string]*gerrit.File{})
+	g := gerrit.New(fs.GerritURL())
+	g.Retry.MaxAttempts = 1
+	s := &commentSink{server: g}
+
+	ps := &gerrit.CheckablePatchSetInfo{Repository: "repo", ChangeNumber: 1, PatchSetID: 1}
+	results := []*checkResult{{
+		PatchSet: ps,
+		Language: "go",
+		Status:   gerrit.StateFailed,
+		Files: []fileResult{
+			{Name: "a.go", Message: "not formatted", Original: []byte("a\nb\nc\nd\n"), Formatted: []byte("A\nb\nc\nD\n")},
+			{Name: "b.go", Message: "syntax error"},
+		},
+	}}
+	if err := s.FinishPatchSet(context.Background(), ps, results); err != nil {
+		t.Fatalf("FinishPatchSet: %v", err)
+	}
+
+	reviews := fs.Reviews(1, 1)
+	if len(reviews) != 1 {
+		t.Fatalf("got %d reviews, want 1", len(reviews))
+	}
+	var got []string
+	for _, name := range []string{"a.go", "b.go"} {
+		for _, c := range reviews[0].RobotComments[name] {
+			desc := fmt.Sprintf("%s:%d %s", name, c.Line, c.Message)
+			for _, fix := range c.FixSuggestions {
+				for _, r := range fix.Replacements {
+					desc += fmt.Sprintf(" [%d:%d-%d:%d %q]", r.Range.StartLine, r.Range.StartCharacter,
+						r.Range.EndLine, r.Range.EndCharacter, r.Replacement)
+				}
+			}
+			got = append(got, desc)
+		}
+	}
+	want := []string{
+		`a.go:1 go formatting: not formatted [1:0-2:0 "A\n"]`,
+		`a.go:4 go formatting: not formatted [4:0-4:1 "D"]`,
+		`b.go:0 go formatting: syntax error`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("comments: got %q, want %q", got, want)
+	}
+}
+
+func TestLabelVote(t *testing.T) {
+	ok := &checkResult{Status: gerrit.StateSuccessful}
+	bad := &checkResult{Status: gerrit.StateFailed}
+	broken := &checkResult{Status: gerrit.StateFailed, ToolFailure: true}
+	irrelevant := &checkResult{Status: gerrit.StateNotRelevant}
+	pending := &checkResult{Status: gerrit.StateNotStarted}
+	running := &checkResult{Status: gerrit.StateRunning}
+
+	for _, tc := range []struct {
+		name    string
+		results []*checkResult
+		want    int
+	}{
+		{"none", nil, 0},
+		{"success", []*checkResult{ok, irrelevant}, 1},
+		{"irrelevant", []*checkResult{irrelevant}, 0},
+		{"failure", []*checkResult{ok, bad}, -1},
+		{"tool failure", []*checkResult{broken}, 0},
+		{"tool failure and success", []*checkResult{ok, broken}, 0},
+		{"tool failure and failure", []*checkResult{broken, bad}, -1},
+		{"pending and success", []*checkResult{ok, pending}, 0},
+		{"running and success", []*checkResult{running, ok}, 0},
+		{"pending and failure", []*checkResult{pending, bad}, -1},
+	} {
+		if got := labelVote(tc.results); got != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"path"
+	"strconv"
+	"sync"
+
+	linter "github.com/google/gerrit-linter"
+	"github.com/google/gerrit-linter/gerrit"
+)
+
+// snapshot holds the contents of a patchset. It is fetched once, and
+// shared by all the checkers that run on the patchset.
+type snapshot struct {
+	source gerrit.ChangeSource
+	ps     *gerrit.CheckablePatchSetInfo
+
+	changeOnce sync.Once
+	change     *gerrit.Change
+	changeErr  error
+
+	attrsOnce sync.Once
+	attrs     *linter.GitAttributes
+	attrsErr  error
+}
+
+// newSnapshot returns a snapshot for the given patchset. Nothing is
+// fetched until it is needed.
+func newSnapshot(source gerrit.ChangeSource, ps *gerrit.CheckablePatchSetInfo) *snapshot {
+	return &snapshot{
+		source: source,
+		ps:     ps,
+	}
+}
+
+// sourceChangeID returns the "project~number" change ID, which
+// identifies the change both to Gerrit and to a git mirror.
+func sourceChangeID(ps *gerrit.CheckablePatchSetInfo) string {
+	return ps.Repository + "~" + strconv.Itoa(ps.ChangeNumber)
+}
+
+// Change returns the files of the patchset.
+func (s *snapshot) Change(ctx context.Context) (*gerrit.Change, error) {
+	s.changeOnce.Do(func() {
+		s.change, s.changeErr = s.source.GetChangeContext(ctx,
+			sourceChangeID(s.ps), strconv.Itoa(s.ps.PatchSetID))
+	})
+	return s.change, s.changeErr
+}
+
+// GitAttributes returns the .gitattributes files that apply to the
+// files of the patchset.
+func (s *snapshot) GitAttributes(ctx context.Context) (*linter.GitAttributes, error) {
+	s.attrsOnce.Do(func() {
+		s.attrs, s.attrsErr = s.fetchGitAttributes(ctx)
+	})
+	return s.attrs, s.attrsErr
+}
+
+func (s *snapshot) fetchGitAttributes(ctx context.Context) (*linter.GitAttributes, error) {
+	ch, err := s.Change(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := map[string]bool{"": true}
+	for n := range ch.Files {
+		for d := path.Dir(n); d != "." && d != "/"; d = path.Dir(d) {
+			dirs[d] = true
+		}
+	}
+
+	attrs := &linter.GitAttributes{}
+	for d := range dirs {
+		name := path.Join(d, ".gitattributes")
+		if f, ok := ch.Files[name]; ok {
+			attrs.Add(d, f.Content)
+			continue
+		}
+
+		content, err := s.source.GetContentContext(ctx, sourceChangeID(s.ps),
+			strconv.Itoa(s.ps.PatchSetID), name)
+		if gerrit.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		attrs.Add(d, content)
+	}
+	return attrs, nil
+}
@@ -0,0 +1,275 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gerrit-linter/gerrit"
+)
+
+// enqueueFunc submits a patchset for checking. It blocks while the
+// queue is full, and fails if the context is done first.
+type enqueueFunc func(context.Context, *gerrit.PendingChecksInfo) error
+
+// workSource produces patchsets to check.
+type workSource interface {
+	// Run feeds patchsets into enqueue until the context is done.
+	Run(ctx context.Context, enqueue enqueueFunc)
+}
+
+// pendingFunc returns the checks to run on a patchset: the given
+// checkers, or those of the repository if uuids is empty. Checks that
+// already finished are left out, unless rerun is set.
+type pendingFunc func(ctx context.Context, ps *gerrit.CheckablePatchSetInfo, uuids []string, rerun bool) (*gerrit.PendingChecksInfo, error)
+
+// pendingInfo returns a PendingChecksInfo for all checkers of a
+// patchset.
+func pendingInfo(ps *gerrit.CheckablePatchSetInfo, uuids []string) *gerrit.PendingChecksInfo {
+	pc := &gerrit.PendingChecksInfo{
+		PatchSet:      ps,
+		PendingChecks: map[string]*gerrit.PendingCheckInfo{},
+	}
+	for _, u := range uuids {
+		pc.PendingChecks[u] = &gerrit.PendingCheckInfo{State: gerrit.StateNotStarted}
+	}
+	return pc
+}
+
+// pendingSource polls the checks plugin for pending checks.
+type pendingSource struct {
+	server   *gerrit.Server
+	interval time.Duration
+}
+
+func (s *pendingSource) Run(ctx context.Context, enqueue enqueueFunc) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.interval):
+		}
+
+		pending, err := s.server.PendingChecksBySchemeContext(ctx, checkerScheme)
+		if err != nil {
+			log.Printf("PendingChecksByScheme: %v", err)
+			continue
+		}
+
+		if len(pending) == 0 {
+			log.Printf("no pending checks")
+		}
+
+		for _, pc := range pending {
+			if err := enqueue(ctx, pc); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// queryPageSize is the number of changes that the query source
+// fetches per request.
+const queryPageSize = 100
+
+// seenTTL is how long the query source remembers patchsets after they
+// last matched its query. A patchset that matches again within that
+// time, eg. because its change was updated and is back within an
+// "-age:" bound, is not checked again.
+const seenTTL = 7 * 24 * time.Hour
+
+// querySource polls a change query, for hosts without the checks
+// plugin. Each patchset is enqueued once. The query runs on every
+// poll, so it should be bounded, eg. with "-age:".
+type querySource struct {
+	server   *gerrit.Server
+	query    string
+	interval time.Duration
+	pending  pendingFunc
+}
+
+func (s *querySource) Run(ctx context.Context, enqueue enqueueFunc) {
+	// seen holds the patchsets enqueued before, as
+	// "project~number/patchset", with the time they last matched.
+	seen := map[string]time.Time{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.interval):
+		}
+
+		changes, err := s.server.QueryAllChanges(ctx, s.query, &gerrit.QueryOptions{
+			Options: []string{"CURRENT_REVISION"},
+			Limit:   queryPageSize,
+		})
+		if err != nil {
+			log.Printf("QueryChanges(%q): %v", s.query, err)
+			continue
+		}
+
+		now := time.Now()
+		for _, c := range changes {
+			rev := c.CurrentRevisionInfo()
+			if rev == nil {
+				continue
+			}
+			ps := &gerrit.CheckablePatchSetInfo{
+				Repository:   c.Project,
+				ChangeNumber: c.Number,
+				PatchSetID:   rev.Number,
+			}
+			key := patchSetKey(ps)
+			_, ok := seen[key]
+			seen[key] = now
+			if ok {
+				continue
+			}
+			pc, err := s.pending(ctx, ps, nil, false)
+			if err == errNoCheckers {
+				continue
+			} else if err != nil {
+				log.Printf("checks for %s: %v", key, err)
+				// Try again on the next poll.
+				delete(seen, key)
+				continue
+			}
+			if len(pc.PendingChecks) > 0 {
+				if err := enqueue(ctx, pc); err != nil {
+					return
+				}
+			}
+		}
+
+		// Forget patchsets that stopped matching a while ago, so
+		// the set doesn't grow without bounds.
+		for key, t := range seen {
+			if now.Sub(t) > seenTTL {
+				delete(seen, key)
+			}
+		}
+	}
+}
+
+// httpSource is a work source fed by HTTP requests.
+type httpSource struct {
+	pending pendingFunc
+	work    chan *gerrit.PendingChecksInfo
+}
+
+func newHTTPSource(pending pendingFunc) *httpSource {
+	return &httpSource{
+		pending: pending,
+		work:    make(chan *gerrit.PendingChecksInfo),
+	}
+}
+
+func (s *httpSource) Run(ctx context.Context, enqueue enqueueFunc) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case pc := <-s.work:
+			if err := enqueue(ctx, pc); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// submit hands the checks for a patchset to Run, and reports failure
+// to the client. The arguments are as for pendingFunc.
+func (s *httpSource) submit(w http.ResponseWriter, req *http.Request, ps *gerrit.CheckablePatchSetInfo, uuids []string, rerun bool) {
+	pc, err := s.pending(req.Context(), ps, uuids, rerun)
+	if err == errNoCheckers {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if len(pc.PendingChecks) == 0 {
+		// All checks already finished.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	select {
+	case s.work <- pc:
+		w.WriteHeader(http.StatusAccepted)
+	case <-req.Context().Done():
+		http.Error(w, "not accepting work", http.StatusServiceUnavailable)
+	}
+}
+
+// secretMatches compares a secret supplied by a client in constant
+// time. An empty secret never matches.
+func secretMatches(got, want string) bool {
+	return want != "" && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// manualSource enqueues patchsets posted as form values "repo",
+// "change" and "patchset". Optional "checker" values select the
+// checkers to run.
+type manualSource struct {
+	*httpSource
+
+	// secret must be supplied as "Authorization: Bearer SECRET".
+	secret string
+}
+
+func (s *manualSource) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "want POST", http.StatusMethodNotAllowed)
+		return
+	}
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") || !secretMatches(auth[len("Bearer "):], s.secret) {
+		http.Error(w, "bad secret", http.StatusForbidden)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	repo := req.Form.Get("repo")
+	change, err1 := strconv.Atoi(req.Form.Get("change"))
+	ps, err2 := strconv.Atoi(req.Form.Get("patchset"))
+	if repo == "" || err1 != nil || err2 != nil {
+		http.Error(w, "need repo, change and patchset", http.StatusBadRequest)
+		return
+	}
+	for _, uuid := range req.Form["checker"] {
+		if _, ok := checkerLanguage(uuid); !ok {
+			http.Error(w, fmt.Sprintf("unknown checker %q", uuid), http.StatusBadRequest)
+			return
+		}
+	}
+
+	log.Printf("enqueue: %s~%d/%d", repo, change, ps)
+	s.submit(w, req, &gerrit.CheckablePatchSetInfo{
+		Repository:   repo,
+		ChangeNumber: change,
+		PatchSetID:   ps,
+	}, req.Form["checker"], true)
+}
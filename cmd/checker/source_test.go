@@ -0,0 +1,196 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gerrit-linter/gerrit"
+)
+
+// fixedPending returns a pendingFunc that runs the given checkers,
+// unless others are named.
+func fixedPending(checkers ...string) pendingFunc {
+	return func(ctx context.Context, ps *gerrit.CheckablePatchSetInfo, uuids []string, rerun bool) (*gerrit.PendingChecksInfo, error) {
+		if len(uuids) == 0 {
+			uuids = checkers
+		}
+		if len(uuids) == 0 {
+			return nil, errNoCheckers
+		}
+		return pendingInfo(ps, uuids), nil
+	}
+}
+
+func TestManualSourceSecret(t *testing.T) {
+	s := &manualSource{newHTTPSource(fixedPending("fmt:gerrit-go")), "s3cret"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan *gerrit.PendingChecksInfo, 1)
+	go s.Run(ctx, func(ctx context.Context, pc *gerrit.PendingChecksInfo) error {
+		got <- pc
+		return nil
+	})
+
+	form := url.Values{"repo": {"gerrit"}, "change": {"1"}, "patchset": {"2"}}.Encode()
+	for _, tc := range []struct {
+		auth string
+		want int
+	}{
+		{"", http.StatusForbidden},
+		{"Bearer wrong", http.StatusForbidden},
+		{"s3cret", http.StatusForbidden},
+		{"Bearer s3cret", http.StatusAccepted},
+	} {
+		req := httptest.NewRequest("POST", "/enqueue", strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("Authorization %q: got status %d, want %d", tc.auth, rec.Code, tc.want)
+		}
+	}
+
+	select {
+	case pc := <-got:
+		if pc.PatchSet.Repository != "gerrit" || pc.PatchSet.ChangeNumber != 1 || pc.PatchSet.PatchSetID != 2 {
+			t.Errorf("got patchset %+v", pc.PatchSet)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no patchset enqueued")
+	}
+	select {
+	case pc := <-got:
+		t.Errorf("unexpected patchset %+v", pc.PatchSet)
+	default:
+	}
+}
+
+func TestManualSourceNoSecret(t *testing.T) {
+	s := &manualSource{newHTTPSource(fixedPending()), ""}
+	req := httptest.NewRequest("POST", "/enqueue", strings.NewReader("repo=gerrit&change=1&patchset=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer ")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+// newSourceServer returns a Server talking to h, without retries.
+func newSourceServer(t *testing.T, h http.HandlerFunc) (*gerrit.Server, *httptest.Server) {
+	ts := httptest.NewServer(h)
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		ts.Close()
+		t.Fatal(err)
+	}
+	g := gerrit.New(*u)
+	g.Retry.MaxAttempts = 1
+	return g, ts
+}
+
+// runSource runs s until it enqueued n patchsets, and returns them as
+// "project~number/patchset" strings.
+func runSource(t *testing.T, s workSource, n int) []string {
+	ctx, cancel := context.WithCancel(context.Background())
+	got := make(chan *gerrit.PendingChecksInfo)
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx, func(ctx context.Context, pc *gerrit.PendingChecksInfo) error {
+			select {
+			case got <- pc:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		close(done)
+	}()
+
+	var out []string
+	for len(out) < n {
+		select {
+		case pc := <-got:
+			out = append(out, patchSetKey(pc.PatchSet))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %q, want %d patchsets", out, n)
+		}
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after cancel")
+	}
+	return out
+}
+
+func TestPendingSource(t *testing.T) {
+	g, ts := newSourceServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/a/plugins/checks/checks.pending/" || r.URL.Query().Get("query") != "scheme:"+checkerScheme {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`)]}'
+[{"patch_set":{"repository":"r","change_number":1,"patch_set_id":2},
+  "pending_checks":{"fmt:go-1":{"state":"NOT_STARTED"}}}]`))
+	})
+	defer ts.Close()
+
+	got := runSource(t, &pendingSource{server: g, interval: time.Millisecond}, 2)
+	if want := []string{"r~1/2", "r~1/2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestQuerySource(t *testing.T) {
+	// Each poll sees a new patchset of change 1, and the same
+	// patchset of change 2.
+	var polls int32
+	g, ts := newSourceServer(t, func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/a/changes/" || q.Get("q") != "status:open -age:1d" || q.Get("n") != strconv.Itoa(queryPageSize) {
+			http.Error(w, "unexpected request "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		ps := atomic.AddInt32(&polls, 1)
+		fmt.Fprintf(w, `)]}'
+[{"project":"r","_number":1,"current_revision":"a","revisions":{"a":{"_number":%d}}},
+ {"project":"r","_number":2,"current_revision":"b","revisions":{"b":{"_number":1}}}]`, ps)
+	})
+	defer ts.Close()
+
+	s := &querySource{server: g, query: "status:open -age:1d", interval: time.Millisecond, pending: fixedPending(checkerUUID("r", "go"))}
+	got := runSource(t, s, 4)
+	if want := []string{"r~1/1", "r~2/1", "r~1/2", "r~1/3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
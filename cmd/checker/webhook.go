@@ -0,0 +1,141 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/google/gerrit-linter/gerrit"
+)
+
+// eventNumber is a change or patchset number in a Gerrit event. Older
+// Gerrit versions send these as strings.
+type eventNumber int
+
+func (n *eventNumber) UnmarshalJSON(b []byte) error {
+	i, err := strconv.Atoi(string(bytes.Trim(b, `"`)))
+	if err != nil {
+		return err
+	}
+	*n = eventNumber(i)
+	return nil
+}
+
+// gerritEvent is the part of a Gerrit stream event, as sent by the
+// webhooks plugin, that we use.
+type gerritEvent struct {
+	Type   string `json:"type"`
+	Change struct {
+		Project string      `json:"project"`
+		Number  eventNumber `json:"number"`
+	} `json:"change"`
+	PatchSet struct {
+		Number eventNumber `json:"number"`
+	} `json:"patchSet"`
+
+	// Comment is set for comment-added.
+	Comment string `json:"comment"`
+}
+
+// webhookSecretHeader carries the shared secret, for senders that
+// can set headers. The webhooks plugin can't, so the secret may
+// also be passed as the "secret" query parameter of the webhook URL.
+const webhookSecretHeader = "X-Gerrit-Webhook-Secret"
+
+// defaultRecheckPattern matches comments that request a new check.
+const defaultRecheckPattern = `(?im)^\s*recheck\s*$`
+
+// webhookSource receives events from the Gerrit webhooks plugin. It
+// checks patchsets on patchset-created and change-restored, and on
+// comment-added for comments that match recheck.
+type webhookSource struct {
+	*httpSource
+
+	// secret, if set, must be supplied with each request.
+	secret string
+
+	// recheck matches the comments that trigger a check.
+	recheck *regexp.Regexp
+}
+
+// newWebhookSource creates a webhook receiver that enqueues the checks
+// returned by pending.
+func newWebhookSource(pending pendingFunc, secret string) *webhookSource {
+	return &webhookSource{
+		httpSource: newHTTPSource(pending),
+		secret:     secret,
+		recheck:    regexp.MustCompile(defaultRecheckPattern),
+	}
+}
+
+// authorized returns if the request carries the shared secret.
+func (s *webhookSource) authorized(req *http.Request) bool {
+	if s.secret == "" {
+		return true
+	}
+	got := req.Header.Get(webhookSecretHeader)
+	if got == "" {
+		got = req.URL.Query().Get("secret")
+	}
+	return secretMatches(got, s.secret)
+}
+
+// wants returns if an event should trigger a check.
+func (s *webhookSource) wants(ev *gerritEvent) bool {
+	switch ev.Type {
+	case "patchset-created", "change-restored":
+		return true
+	case "comment-added":
+		return s.recheck.MatchString(ev.Comment)
+	}
+	return false
+}
+
+func (s *webhookSource) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "want POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(req) {
+		http.Error(w, "bad secret", http.StatusForbidden)
+		return
+	}
+
+	var ev gerritEvent
+	if err := json.NewDecoder(req.Body).Decode(&ev); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.wants(&ev) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if ev.Change.Project == "" || ev.Change.Number == 0 || ev.PatchSet.Number == 0 {
+		http.Error(w, "event lacks project, change or patchset", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("webhook: %s for %s~%d/%d", ev.Type, ev.Change.Project, ev.Change.Number, ev.PatchSet.Number)
+	s.submit(w, req, &gerrit.CheckablePatchSetInfo{
+		Repository:   ev.Change.Project,
+		ChangeNumber: int(ev.Change.Number),
+		PatchSetID:   int(ev.PatchSet.Number),
+	}, nil, ev.Type == "comment-added")
+}
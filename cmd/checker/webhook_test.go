@@ -0,0 +1,134 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gerrit-linter/gerrit"
+)
+
+func TestWebhookSource(t *testing.T) {
+	var mu sync.Mutex
+	reruns := map[string]bool{}
+	pending := func(ctx context.Context, ps *gerrit.CheckablePatchSetInfo, uuids []string, rerun bool) (*gerrit.PendingChecksInfo, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		reruns[patchSetKey(ps)] = rerun
+		return pendingInfo(ps, []string{checkerUUID(ps.Repository, "go")}), nil
+	}
+	s := newWebhookSource(pending, "s3cret")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan *gerrit.PendingChecksInfo, 10)
+	go s.Run(ctx, func(ctx context.Context, pc *gerrit.PendingChecksInfo) error {
+		got <- pc
+		return nil
+	})
+
+	const created = `{"type":"patchset-created","change":{"project":"r","number":1},"patchSet":{"number":2}}`
+	for _, tc := range []struct {
+		name      string
+		method    string
+		target    string
+		header    string
+		body      string
+		want      int
+		wantPS    string
+		wantRerun bool
+	}{
+		{"header secret", "POST", "/webhook", "s3cret", created, http.StatusAccepted, "r~1/2", false},
+		{"query secret", "POST", "/webhook?secret=s3cret", "", created, http.StatusAccepted, "r~1/2", false},
+		{"wrong header secret", "POST", "/webhook", "wrong", created, http.StatusForbidden, "", false},
+		{"wrong query secret", "POST", "/webhook?secret=wrong", "", created, http.StatusForbidden, "", false},
+		{"no secret", "POST", "/webhook", "", created, http.StatusForbidden, "", false},
+		{"GET", "GET", "/webhook?secret=s3cret", "", "", http.StatusMethodNotAllowed, "", false},
+		{"string numbers", "POST", "/webhook", "s3cret",
+			`{"type":"change-restored","change":{"project":"r","number":"3"},"patchSet":{"number":"4"}}`,
+			http.StatusAccepted, "r~3/4", false},
+		{"recheck", "POST", "/webhook", "s3cret",
+			`{"type":"comment-added","change":{"project":"r","number":5},"patchSet":{"number":1},"comment":"Patch Set 1:\n\n  recheck \n"}`,
+			http.StatusAccepted, "r~5/1", true},
+		{"other comment", "POST", "/webhook", "s3cret",
+			`{"type":"comment-added","change":{"project":"r","number":5},"patchSet":{"number":1},"comment":"please don't recheck"}`,
+			http.StatusNoContent, "", false},
+		{"ignored type", "POST", "/webhook", "s3cret",
+			`{"type":"ref-updated","refUpdate":{"project":"r"}}`,
+			http.StatusNoContent, "", false},
+		{"missing patchset", "POST", "/webhook", "s3cret",
+			`{"type":"patchset-created","change":{"project":"r","number":1}}`,
+			http.StatusBadRequest, "", false},
+		{"missing project", "POST", "/webhook", "s3cret",
+			`{"type":"patchset-created","change":{"number":1},"patchSet":{"number":2}}`,
+			http.StatusBadRequest, "", false},
+		{"bad number", "POST", "/webhook", "s3cret",
+			`{"type":"patchset-created","change":{"project":"r","number":"x"},"patchSet":{"number":2}}`,
+			http.StatusBadRequest, "", false},
+		{"bad JSON", "POST", "/webhook", "s3cret", `{`, http.StatusBadRequest, "", false},
+	} {
+		req := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+		if tc.header != "" {
+			req.Header.Set(webhookSecretHeader, tc.header)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.name, rec.Code, tc.want)
+			continue
+		}
+		if tc.wantPS == "" {
+			select {
+			case pc := <-got:
+				t.Errorf("%s: unexpected patchset %s", tc.name, patchSetKey(pc.PatchSet))
+			case <-time.After(10 * time.Millisecond):
+			}
+			continue
+		}
+		select {
+		case pc := <-got:
+			if key := patchSetKey(pc.PatchSet); key != tc.wantPS {
+				t.Errorf("%s: got patchset %s, want %s", tc.name, key, tc.wantPS)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: no patchset enqueued", tc.name)
+		}
+		mu.Lock()
+		if rerun := reruns[tc.wantPS]; rerun != tc.wantRerun {
+			t.Errorf("%s: got rerun %v, want %v", tc.name, rerun, tc.wantRerun)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestWebhookSourceNoSecret(t *testing.T) {
+	s := newWebhookSource(fixedPending(), "")
+	req := httptest.NewRequest("POST", "/webhook",
+		strings.NewReader(`{"type":"patchset-created","change":{"project":"r","number":1},"patchSet":{"number":2}}`))
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+
+	// Without a secret, any request is accepted, but there are no
+	// checkers for the repository.
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gerritlinter
+
+import (
+	"bufio"
+	"bytes"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// GeneratedMarkers holds the patterns that mark a file as generated
+// when they occur in its content. The default matches the standard
+// "Code generated ... DO NOT EDIT." header in the common comment
+// syntaxes.
+var GeneratedMarkers = []*regexp.Regexp{
+	regexp.MustCompile(`(?m)^\s*(//|#|/?\*|--|;+)\s*Code generated .* DO NOT EDIT\.`),
+}
+
+// IsGeneratedContent returns if the content matches one of the
+// given markers.
+func IsGeneratedContent(content []byte, markers []*regexp.Regexp) bool {
+	for _, m := range markers {
+		if m.Match(content) {
+			return true
+		}
+	}
+	return false
+}
+
+// generatedAttr is the attribute by which .gitattributes files mark
+// generated files.
+const generatedAttr = "linguist-generated"
+
+// attrRule is a single line of a .gitattributes file.
+type attrRule struct {
+	re    *regexp.Regexp
+	attrs map[string]string
+}
+
+// GitAttributes holds the .gitattributes files of a tree.
+type GitAttributes struct {
+	// rules per directory. The root directory is "".
+	rules map[string][]attrRule
+}
+
+// Add parses the content of the .gitattributes file in the given
+// directory.
+func (a *GitAttributes) Add(dir string, content []byte) {
+	if a.rules == nil {
+		a.rules = map[string][]attrRule{}
+	}
+
+	dir = strings.Trim(dir, "/")
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		re, err := attrPatternRegexp(fields[0])
+		if err != nil {
+			continue
+		}
+
+		rule := attrRule{re: re, attrs: map[string]string{}}
+		for _, f := range fields[1:] {
+			switch {
+			case strings.HasPrefix(f, "-"):
+				rule.attrs[f[1:]] = "false"
+			case strings.HasPrefix(f, "!"):
+				rule.attrs[f[1:]] = ""
+			case strings.Contains(f, "="):
+				kv := strings.SplitN(f, "=", 2)
+				rule.attrs[kv[0]] = kv[1]
+			default:
+				rule.attrs[f] = "true"
+			}
+		}
+		a.rules[dir] = append(a.rules[dir], rule)
+	}
+}
+
+// Value returns the value of an attribute for the given file. Files
+// in deeper directories override files higher up, and later lines
+// override earlier ones. It returns false if the attribute is
+// unspecified.
+func (a *GitAttributes) Value(name, attr string) (string, bool) {
+	name = strings.Trim(name, "/")
+
+	var dirs []string
+	for d := path.Dir(name); d != "." && d != "/"; d = path.Dir(d) {
+		dirs = append(dirs, d)
+	}
+	dirs = append(dirs, "")
+
+	val, found := "", false
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rel := name
+		if dirs[i] != "" {
+			rel = strings.TrimPrefix(name, dirs[i]+"/")
+		}
+		for _, r := range a.rules[dirs[i]] {
+			if !r.re.MatchString(rel) {
+				continue
+			}
+			v, ok := r.attrs[attr]
+			if !ok {
+				continue
+			}
+			val, found = v, v != ""
+		}
+	}
+	return val, found
+}
+
+// IsGenerated returns if the file is marked with linguist-generated.
+func (a *GitAttributes) IsGenerated(name string) bool {
+	v, ok := a.Value(name, generatedAttr)
+	return ok && v != "false"
+}
+
+// attrPatternRegexp converts a .gitattributes pattern into a
+// regular expression that matches paths relative to the directory
+// holding the .gitattributes file.
+func attrPatternRegexp(pat string) (*regexp.Regexp, error) {
+	// Patterns without a slash match the basename at any depth.
+	anchored := strings.Contains(strings.TrimSuffix(pat, "/"), "/")
+	pat = strings.TrimPrefix(pat, "/")
+
+	var buf strings.Builder
+	buf.WriteString("^")
+	if !anchored {
+		buf.WriteString("(.*/)?")
+	}
+	for i := 0; i < len(pat); i++ {
+		c := pat[i]
+		switch {
+		case strings.HasPrefix(pat[i:], "**/"):
+			buf.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pat[i:], "**"):
+			buf.WriteString(".*")
+			i++
+		case c == '*':
+			buf.WriteString("[^/]*")
+		case c == '?':
+			buf.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pat[i:], ']')
+			if end < 0 {
+				buf.WriteString(`\[`)
+				continue
+			}
+			class := pat[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + class + "]")
+			i += end
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	buf.WriteString("$")
+	return regexp.Compile(buf.String())
+}
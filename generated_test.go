@@ -0,0 +1,145 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gerritlinter
+
+import "testing"
+
+func TestAttrPatternRegexp(t *testing.T) {
+	for _, tc := range []struct {
+		pat  string
+		name string
+		want bool
+	}{
+		// Patterns without a slash match the basename at any depth.
+		{"*.pb.go", "x.pb.go", true},
+		{"*.pb.go", "a/b/x.pb.go", true},
+		{"*.pb.go", "x.go", false},
+		{"x?.go", "xy.go", true},
+		{"x?.go", "x/.go", false},
+		{"[ab].go", "a.go", true},
+		{"[!ab].go", "a.go", false},
+		{"[!ab].go", "c.go", true},
+
+		// A leading slash anchors the pattern.
+		{"/x.go", "x.go", true},
+		{"/x.go", "a/x.go", false},
+
+		// A slash in the middle anchors it too.
+		{"gen/x.go", "gen/x.go", true},
+		{"gen/x.go", "a/gen/x.go", false},
+		{"gen/*.go", "gen/sub/x.go", false},
+
+		// Leading "**/" matches in all directories.
+		{"**/x.go", "x.go", true},
+		{"**/x.go", "a/b/x.go", true},
+
+		// Trailing "/**" matches everything inside.
+		{"gen/**", "gen/x.go", true},
+		{"gen/**", "gen/a/b/x.go", true},
+		{"gen/**", "gen", false},
+		{"gen/**", "a/gen/x.go", false},
+
+		// "/**/" matches zero or more directories.
+		{"a/**/x.go", "a/x.go", true},
+		{"a/**/x.go", "a/b/c/x.go", true},
+		{"a/**/x.go", "b/x.go", false},
+
+		// Directory patterns don't match the files inside, as in git.
+		{"gen/", "gen/x.go", false},
+		{"gen/", "gen", false},
+	} {
+		re, err := attrPatternRegexp(tc.pat)
+		if err != nil {
+			t.Errorf("attrPatternRegexp(%q): %v", tc.pat, err)
+			continue
+		}
+		if got := re.MatchString(tc.name); got != tc.want {
+			t.Errorf("attrPatternRegexp(%q) (%s) matches %q: got %v, want %v", tc.pat, re, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestGitAttributesIsGenerated(t *testing.T) {
+	var attrs GitAttributes
+	attrs.Add("", []byte(`# comment
+*.pb.go linguist-generated
+/vendor/** linguist-generated=true
+docs/** linguist-generated=false
+testdata/** -linguist-generated
+gen/ linguist-generated
+`))
+	attrs.Add("sub", []byte(`
+*.pb.go -linguist-generated
+keep/** !linguist-generated
+out.go linguist-generated
+`))
+	attrs.Add("sub/keep", []byte(`
+x.go linguist-generated
+`))
+
+	for _, tc := range []struct {
+		name string
+		want bool
+	}{
+		{"a.pb.go", true},
+		{"a/b/a.pb.go", true},
+		{"a.go", false},
+		{"vendor/a/b.go", true},
+		{"x/vendor/b.go", false},
+		{"docs/gen.go", false},
+		{"testdata/gen.go", false},
+		{"gen/x.go", false},
+
+		// Deeper .gitattributes files override higher ones.
+		{"sub/a.pb.go", false},
+		{"sub/deeper/a.pb.go", false},
+		{"sub/out.go", true},
+		{"sub/x/out.go", true},
+		{"out.go", false},
+
+		// "!attr" resets to unspecified, and deeper files can set
+		// it again.
+		{"sub/keep/a.pb.go", false},
+		{"sub/keep/x.go", true},
+	} {
+		if got := attrs.IsGenerated(tc.name); got != tc.want {
+			t.Errorf("IsGenerated(%q): got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestGitAttributesValue(t *testing.T) {
+	var attrs GitAttributes
+	attrs.Add("", []byte(`
+*.go linguist-generated=false
+x.go linguist-generated
+y.go -linguist-generated
+`))
+	for _, tc := range []struct {
+		name      string
+		wantVal   string
+		wantFound bool
+	}{
+		{"a.go", "false", true},
+		{"x.go", "true", true},
+		{"y.go", "false", true},
+		{"a.txt", "", false},
+	} {
+		val, found := attrs.Value(tc.name, generatedAttr)
+		if val != tc.wantVal || found != tc.wantFound {
+			t.Errorf("Value(%q): got %q, %v, want %q, %v", tc.name, val, found, tc.wantVal, tc.wantFound)
+		}
+	}
+}
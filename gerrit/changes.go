@@ -0,0 +1,114 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gerrit
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+)
+
+// QueryOptions configures a change query.
+type QueryOptions struct {
+	// Options are the additional fields to return, eg. "LABELS"
+	// or "CURRENT_REVISION".
+	Options []string
+
+	// Start skips the given number of results.
+	Start int
+
+	// Limit caps the number of results. 0 uses the server's limit.
+	Limit int
+}
+
+// values returns the URL query parameters for the options.
+func (o *QueryOptions) values() url.Values {
+	v := url.Values{}
+	if o == nil {
+		return v
+	}
+	for _, opt := range o.Options {
+		v.Add("o", opt)
+	}
+	if o.Start > 0 {
+		v.Set("S", strconv.Itoa(o.Start))
+	}
+	if o.Limit > 0 {
+		v.Set("n", strconv.Itoa(o.Limit))
+	}
+	return v
+}
+
+// QueryChanges returns a single page of changes matching the
+// query. If there are more results, the last change has MoreChanges
+// set.
+func (s *Server) QueryChanges(ctx context.Context, query string, opts *QueryOptions) ([]*ChangeInfo, error) {
+	v := opts.values()
+	v.Set("q", query)
+
+	var out []*ChangeInfo
+	if err := s.getJSON(ctx, "a/changes/", v.Encode(), &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// QueryAllChanges returns all changes matching the query, fetching
+// pages of opts.Limit changes until the results are exhausted.
+func (s *Server) QueryAllChanges(ctx context.Context, query string, opts *QueryOptions) ([]*ChangeInfo, error) {
+	page := QueryOptions{}
+	if opts != nil {
+		page = *opts
+	}
+
+	var all []*ChangeInfo
+	for {
+		out, err := s.QueryChanges(ctx, query, &page)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, out...)
+		if len(out) == 0 || !out[len(out)-1].MoreChanges {
+			return all, nil
+		}
+		page.Start += len(out)
+	}
+}
+
+// GetChangeInfo returns the metadata of a change. The options select
+// additional fields, as in QueryOptions.
+func (s *Server) GetChangeInfo(ctx context.Context, changeID string, options ...string) (*ChangeInfo, error) {
+	v := url.Values{}
+	for _, opt := range options {
+		v.Add("o", opt)
+	}
+
+	var out ChangeInfo
+	if err := s.getJSON(ctx, "a/changes/"+url.PathEscape(changeID), v.Encode(), &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// SetReview posts a review, with label votes, messages and comments,
+// onto a revision.
+func (s *Server) SetReview(ctx context.Context, changeID string, revID string, in *ReviewInput) (*ReviewResult, error) {
+	var out ReviewResult
+	p := "a/changes/" + url.PathEscape(changeID) + "/revisions/" + url.PathEscape(revID) + "/review"
+	if err := s.postJSON(ctx, p, in, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gerrit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+// checkersPath is the REST collection of checkers.
+const checkersPath = "a/plugins/checks/checkers/"
+
+// checkerPath returns the REST path of a single checker.
+func checkerPath(uuid string) string {
+	return checkersPath + url.PathEscape(uuid)
+}
+
+// checksPath returns the REST collection of checks on a revision.
+func checksPath(changeID string, psID int) string {
+	return fmt.Sprintf("a/changes/%s/revisions/%d/checks/", url.PathEscape(changeID), psID)
+}
+
+// ListChecksOptions are the options for listing checks.
+type ListChecksOptions struct {
+	// Checker includes the checker name, status and blocking
+	// conditions in each CheckInfo.
+	Checker bool
+}
+
+// query returns the URL query for the options.
+func (o *ListChecksOptions) query() string {
+	if o != nil && o.Checker {
+		return "o=CHECKER"
+	}
+	return ""
+}
+
+// RerunInput is the input for rerunning a check.
+type RerunInput struct {
+	Notify string `json:"notify,omitempty"`
+}
+
+// postJSON posts a JSON value onto a path, and unmarshals the response
+// into out.
+func (s *Server) postJSON(ctx context.Context, p string, in interface{}, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.PostPathContext(ctx, p, "application/json", body)
+	if err != nil {
+		return err
+	}
+	return Unmarshal(res, out)
+}
+
+// getJSON runs a Get on the path, and unmarshals the response into out.
+func (s *Server) getJSON(ctx context.Context, p string, query string, out interface{}) error {
+	u := s.pathURL(p)
+	u.RawQuery = query
+	res, err := s.GetContext(ctx, u)
+	if err != nil {
+		return err
+	}
+	return Unmarshal(res, out)
+}
+
+// ListCheckers returns all checkers.
+func (s *Server) ListCheckers(ctx context.Context) ([]*CheckerInfo, error) {
+	var out []*CheckerInfo
+	if err := s.getJSON(ctx, checkersPath, "", &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetChecker returns a single checker.
+func (s *Server) GetChecker(ctx context.Context, uuid string) (*CheckerInfo, error) {
+	var out CheckerInfo
+	if err := s.getJSON(ctx, checkerPath(uuid), "", &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CreateChecker creates a checker.
+func (s *Server) CreateChecker(ctx context.Context, in *CheckerInput) (*CheckerInfo, error) {
+	var out CheckerInfo
+	if err := s.postJSON(ctx, checkersPath, in, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// UpdateChecker changes an existing checker.
+func (s *Server) UpdateChecker(ctx context.Context, uuid string, in *CheckerInput) (*CheckerInfo, error) {
+	var out CheckerInfo
+	if err := s.postJSON(WithIdempotent(ctx), checkerPath(uuid), in, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteChecker deletes a checker.
+func (s *Server) DeleteChecker(ctx context.Context, uuid string) error {
+	_, err := s.doRequest(ctx, "DELETE", s.pathURL(checkerPath(uuid)), "", nil)
+	return err
+}
+
+// ListChecks returns the checks on a revision.
+func (s *Server) ListChecks(ctx context.Context, changeID string, psID int, opts *ListChecksOptions) ([]*CheckInfo, error) {
+	var out []*CheckInfo
+	if err := s.getJSON(ctx, checksPath(changeID, psID), opts.query(), &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetCheck returns a single check on a revision.
+func (s *Server) GetCheck(ctx context.Context, changeID string, psID int, checkerUUID string, opts *ListChecksOptions) (*CheckInfo, error) {
+	var out CheckInfo
+	if err := s.getJSON(ctx, checksPath(changeID, psID)+url.PathEscape(checkerUUID), opts.query(), &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RerunCheck resets a check, so the checker runs it again.
+func (s *Server) RerunCheck(ctx context.Context, changeID string, psID int, checkerUUID string, in *RerunInput) (*CheckInfo, error) {
+	if in == nil {
+		in = &RerunInput{}
+	}
+	var out CheckInfo
+	if err := s.postJSON(ctx, checksPath(changeID, psID)+url.PathEscape(checkerUUID)+"/rerun", in, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
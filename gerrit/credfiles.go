@@ -0,0 +1,287 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gerrit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reloadingFile caches the parsed content of a file, and parses it
+// again when its modification time or size changes.
+type reloadingFile struct {
+	path  string
+	parse func(content []byte) (interface{}, error)
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	value   interface{}
+}
+
+// get returns the parsed content of the file.
+func (f *reloadingFile) get() (interface{}, error) {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.value != nil && fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return f.value, nil
+	}
+
+	content, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	v, err := f.parse(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", f.path, err)
+	}
+	f.value, f.modTime, f.size = v, fi.ModTime(), fi.Size()
+	return v, nil
+}
+
+// invalidate makes the next get read the file again.
+func (f *reloadingFile) invalidate() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.value = nil
+}
+
+// gitCookie is an entry of a .gitcookies file.
+type gitCookie struct {
+	domain     string
+	subdomains bool
+	path       string
+	expires    time.Time
+	name       string
+	value      string
+}
+
+// matches returns whether the cookie applies to a request.
+func (c *gitCookie) matches(host, path string, now time.Time) bool {
+	if !c.expires.IsZero() && c.expires.Before(now) {
+		return false
+	}
+	if !strings.HasPrefix(path, c.path) {
+		return false
+	}
+	domain := strings.TrimPrefix(c.domain, ".")
+	if host == domain {
+		return true
+	}
+	return (c.subdomains || strings.HasPrefix(c.domain, ".")) && strings.HasSuffix(host, "."+domain)
+}
+
+// parseGitCookies parses a file in the Netscape cookie format, as
+// written by the googlesource.com password generator.
+func parseGitCookies(content []byte) (interface{}, error) {
+	var cookies []*gitCookie
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(strings.TrimPrefix(line, "#HttpOnly_"))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("line %d: got %d fields, want 7", i+1, len(fields))
+		}
+		c := &gitCookie{
+			domain:     fields[0],
+			subdomains: fields[1] == "TRUE",
+			path:       fields[2],
+			name:       fields[5],
+			value:      fields[6],
+		}
+		if secs, err := strconv.ParseInt(fields[4], 10, 64); err != nil {
+			return nil, fmt.Errorf("line %d: expiry: %v", i+1, err)
+		} else if secs > 0 {
+			c.expires = time.Unix(secs, 0)
+		}
+		cookies = append(cookies, c)
+	}
+	return cookies, nil
+}
+
+// GitCookies authenticates with the cookies of a .gitcookies file. The
+// file is read again when it changes.
+type GitCookies struct {
+	file *reloadingFile
+}
+
+// NewGitCookies creates a GitCookies authenticator for the given file.
+func NewGitCookies(path string) (*GitCookies, error) {
+	g := &GitCookies{
+		file: &reloadingFile{path: path, parse: parseGitCookies},
+	}
+	if _, err := g.file.get(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *GitCookies) Authenticate(req *http.Request) error {
+	v, err := g.file.get()
+	if err != nil {
+		return err
+	}
+
+	host, path := req.URL.Hostname(), req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	now := time.Now()
+
+	// Prefer the most specific domain, and let later entries override
+	// earlier ones for the same domain.
+	var best *gitCookie
+	for _, c := range v.([]*gitCookie) {
+		if c.matches(host, path, now) && (best == nil || len(c.domain) >= len(best.domain)) {
+			best = c
+		}
+	}
+	if best == nil {
+		return fmt.Errorf("%s: no cookie for %s", g.file.path, host)
+	}
+
+	// Replace the cookie set by a previous attempt.
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != best.name {
+			req.AddCookie(c)
+		}
+	}
+	req.AddCookie(&http.Cookie{Name: best.name, Value: best.value})
+	return nil
+}
+
+// Invalidate makes the next request read the file again.
+func (g *GitCookies) Invalidate() {
+	g.file.invalidate()
+}
+
+// netrcEntry is a machine entry of a .netrc file.
+type netrcEntry struct {
+	login    string
+	password string
+}
+
+// netrc holds the parsed content of a .netrc file.
+type netrc struct {
+	machines map[string]*netrcEntry
+	fallback *netrcEntry
+}
+
+// parseNetrc parses a .netrc file. Macro definitions are skipped.
+func parseNetrc(content []byte) (interface{}, error) {
+	n := &netrc{machines: map[string]*netrcEntry{}}
+	var cur *netrcEntry
+	inMacro := false
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if inMacro {
+			inMacro = len(fields) > 0
+			continue
+		}
+
+		for i := 0; i < len(fields); i++ {
+			arg := ""
+			if i+1 < len(fields) {
+				arg = fields[i+1]
+			}
+			switch fields[i] {
+			case "machine":
+				cur = &netrcEntry{}
+				if _, ok := n.machines[arg]; !ok {
+					n.machines[arg] = cur
+				}
+				i++
+			case "default":
+				cur = &netrcEntry{}
+				n.fallback = cur
+			case "login", "password":
+				if cur == nil {
+					return nil, fmt.Errorf("%q outside a machine entry", fields[i])
+				}
+				if fields[i] == "login" {
+					cur.login = arg
+				} else {
+					cur.password = arg
+				}
+				i++
+			case "account":
+				i++
+			case "macdef":
+				inMacro = true
+				i = len(fields)
+			}
+		}
+	}
+	return n, nil
+}
+
+// Netrc authenticates with the login and password of a .netrc file.
+// The file is read again when it changes.
+type Netrc struct {
+	file *reloadingFile
+}
+
+// NewNetrc creates a Netrc authenticator for the given file.
+func NewNetrc(path string) (*Netrc, error) {
+	n := &Netrc{
+		file: &reloadingFile{path: path, parse: parseNetrc},
+	}
+	if _, err := n.file.get(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (n *Netrc) Authenticate(req *http.Request) error {
+	v, err := n.file.get()
+	if err != nil {
+		return err
+	}
+
+	entries := v.(*netrc)
+	e := entries.machines[req.URL.Host]
+	if e == nil {
+		e = entries.machines[req.URL.Hostname()]
+	}
+	if e == nil {
+		e = entries.fallback
+	}
+	if e == nil {
+		return fmt.Errorf("%s: no entry for %s", n.file.path, req.URL.Hostname())
+	}
+	req.SetBasicAuth(e.login, e.password)
+	return nil
+}
+
+// Invalidate makes the next request read the file again.
+func (n *Netrc) Invalidate() {
+	n.file.invalidate()
+}
@@ -0,0 +1,217 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gerrit
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseGitCookies(t *testing.T) {
+	content := "# Netscape HTTP Cookie File\n" +
+		"\n" +
+		"gerrit.example.com\tFALSE\t/\tTRUE\t0\to\tplain\n" +
+		"#HttpOnly_.googlesource.com\tTRUE\t/\tTRUE\t2147483647\to\tgit-user=secret\n" +
+		"  \n"
+	v, err := parseGitCookies([]byte(content))
+	if err != nil {
+		t.Fatalf("parseGitCookies: %v", err)
+	}
+	want := []*gitCookie{
+		{domain: "gerrit.example.com", path: "/", name: "o", value: "plain"},
+		{domain: ".googlesource.com", subdomains: true, path: "/", expires: time.Unix(2147483647, 0), name: "o", value: "git-user=secret"},
+	}
+	if got := v.([]*gitCookie); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseGitCookies: got %+v, want %+v", got, want)
+	}
+
+	for _, bad := range []string{
+		"gerrit.example.com\tFALSE\t/\tTRUE\t0\to\n",
+		"gerrit.example.com\tFALSE\t/\tTRUE\tsoon\to\tv\n",
+	} {
+		if _, err := parseGitCookies([]byte(bad)); err == nil {
+			t.Errorf("parseGitCookies(%q): got nil error", bad)
+		}
+	}
+}
+
+func TestGitCookieMatches(t *testing.T) {
+	now := time.Unix(1000, 0)
+	for _, tc := range []struct {
+		name   string
+		cookie gitCookie
+		host   string
+		path   string
+		want   bool
+	}{
+		{"exact host", gitCookie{domain: "g.example.com", path: "/"}, "g.example.com", "/a/changes/", true},
+		{"other host", gitCookie{domain: "g.example.com", path: "/"}, "h.example.com", "/", false},
+		{"subdomain without flag", gitCookie{domain: "example.com", path: "/"}, "g.example.com", "/", false},
+		{"subdomain flag", gitCookie{domain: "example.com", subdomains: true, path: "/"}, "g.example.com", "/", true},
+		{"leading dot", gitCookie{domain: ".example.com", path: "/"}, "g.example.com", "/", true},
+		{"leading dot, bare domain", gitCookie{domain: ".example.com", path: "/"}, "example.com", "/", true},
+		{"suffix but not subdomain", gitCookie{domain: ".example.com", path: "/"}, "badexample.com", "/", false},
+		{"path prefix", gitCookie{domain: "g.example.com", path: "/a/"}, "g.example.com", "/a/changes/", true},
+		{"other path", gitCookie{domain: "g.example.com", path: "/a/"}, "g.example.com", "/changes/", false},
+		{"expired", gitCookie{domain: "g.example.com", path: "/", expires: time.Unix(999, 0)}, "g.example.com", "/", false},
+		{"not expired", gitCookie{domain: "g.example.com", path: "/", expires: time.Unix(1001, 0)}, "g.example.com", "/", true},
+	} {
+		if got := tc.cookie.matches(tc.host, tc.path, now); got != tc.want {
+			t.Errorf("%s: matches(%q, %q): got %v, want %v", tc.name, tc.host, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestParseNetrc(t *testing.T) {
+	content := `machine g.example.com login alice password a1
+machine g.example.com:8443
+  login bob
+  password b1
+macdef init
+machine evil.example.com login mallory password m1
+
+machine h.example.com account x login carol password c1
+machine g.example.com login dave password d1
+default login anonymous password guest
+`
+	v, err := parseNetrc([]byte(content))
+	if err != nil {
+		t.Fatalf("parseNetrc: %v", err)
+	}
+	want := &netrc{
+		machines: map[string]*netrcEntry{
+			"g.example.com":      {login: "alice", password: "a1"},
+			"g.example.com:8443": {login: "bob", password: "b1"},
+			"h.example.com":      {login: "carol", password: "c1"},
+		},
+		fallback: &netrcEntry{login: "anonymous", password: "guest"},
+	}
+	if got := v.(*netrc); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseNetrc: got %+v, want %+v", got, want)
+	}
+
+	if _, err := parseNetrc([]byte("login alice password a1\n")); err == nil {
+		t.Errorf("parseNetrc without machine: got nil error")
+	}
+}
+
+func TestNetrcAuthenticate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "netrc")
+	if err := ioutil.WriteFile(name, []byte(`machine g.example.com login alice password a1
+machine g.example.com:8443 login bob password b1
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	n, err := NewNetrc(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		url  string
+		want string
+	}{
+		{"https://g.example.com/a/changes/", "alice"},
+		{"https://g.example.com:8443/a/changes/", "bob"},
+		{"http://g.example.com:8080/a/changes/", "alice"},
+		{"https://h.example.com/a/changes/", ""},
+	} {
+		req, _ := http.NewRequest("GET", tc.url, nil)
+		err := n.Authenticate(req)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%s: got nil error", tc.url)
+			}
+			continue
+		}
+		if user, _, _ := req.BasicAuth(); err != nil || user != tc.want {
+			t.Errorf("%s: got user %q, err %v, want %q", tc.url, user, err, tc.want)
+		}
+	}
+
+	// A default entry applies to all other hosts.
+	if err := ioutil.WriteFile(name, []byte("default login anonymous password guest\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(name, later, later); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "https://h.example.com/", nil)
+	if err := n.Authenticate(req); err != nil {
+		t.Fatalf("Authenticate after reload: %v", err)
+	}
+	if user, _, _ := req.BasicAuth(); user != "anonymous" {
+		t.Errorf("after reload: got user %q, want anonymous", user)
+	}
+}
+
+func TestGitCookiesReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitcookies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "gitcookies")
+	write := func(value string, mtime time.Time) {
+		content := "#HttpOnly_.example.com\tTRUE\t/\tTRUE\t0\to\t" + value + "\n" +
+			"g.example.com\tFALSE\t/\tTRUE\t0\to\tspecific-" + value + "\n"
+		if err := ioutil.WriteFile(name, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cookie := func(g *GitCookies, u string) string {
+		req, _ := http.NewRequest("GET", u, nil)
+		if err := g.Authenticate(req); err != nil {
+			t.Fatalf("Authenticate(%s): %v", u, err)
+		}
+		c, err := req.Cookie("o")
+		if err != nil {
+			t.Fatalf("Authenticate(%s): %v", u, err)
+		}
+		return c.Value
+	}
+
+	now := time.Now()
+	write("v1", now)
+	g, err := NewGitCookies(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cookie(g, "https://h.example.com/a/changes/"); got != "v1" {
+		t.Errorf("subdomain: got %q, want v1", got)
+	}
+	if got := cookie(g, "https://g.example.com/a/changes/"); got != "specific-v1" {
+		t.Errorf("most specific domain: got %q, want specific-v1", got)
+	}
+
+	write("v2", now.Add(time.Minute))
+	if got := cookie(g, "https://h.example.com/a/changes/"); got != "v2" {
+		t.Errorf("after the file changed: got %q, want v2", got)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gerrit
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrNotFound is returned by ChangeSources that are not backed by
+// HTTP when a file does not exist.
+var ErrNotFound = errors.New("not found")
+
+// maxErrorBody is the number of bytes of the response body kept in
+// an Error.
+const maxErrorBody = 512
+
+// traceHeader is the header in which Gerrit returns the trace ID of a
+// request.
+const traceHeader = "X-Gerrit-Trace"
+
+// Error is returned when Gerrit answers a request with a non-2xx
+// status.
+type Error struct {
+	Method     string
+	URL        string
+	StatusCode int
+
+	// Body holds the start of the response body.
+	Body string
+
+	// TraceID is the Gerrit trace ID of the request, if any.
+	TraceID string
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s %s: status %d", e.Method, e.URL, e.StatusCode)
+	if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	if e.TraceID != "" {
+		msg += " (trace " + e.TraceID + ")"
+	}
+	return msg
+}
+
+// newError creates an Error for a failed request.
+func newError(method, u string, rep *http.Response, body []byte) *Error {
+	if len(body) > maxErrorBody {
+		body = body[:maxErrorBody]
+	}
+	return &Error{
+		Method:     method,
+		URL:        u,
+		StatusCode: rep.StatusCode,
+		Body:       string(body),
+		TraceID:    rep.Header.Get(traceHeader),
+	}
+}
+
+// StatusCode returns the HTTP status of a Gerrit error, or 0 if err
+// does not come from a Gerrit response.
+func StatusCode(err error) int {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.StatusCode
+	}
+	return 0
+}
+
+// IsNotFound returns if err is a 404 response or ErrNotFound.
+func IsNotFound(err error) bool {
+	return StatusCode(err) == http.StatusNotFound || errors.Is(err, ErrNotFound)
+}
+
+// IsConflict returns if err is a 409 response.
+func IsConflict(err error) bool {
+	return StatusCode(err) == http.StatusConflict
+}
+
+// IsTooManyRequests returns if err is a 429 response.
+func IsTooManyRequests(err error) bool {
+	return StatusCode(err) == http.StatusTooManyRequests
+}
@@ -0,0 +1,581 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fake provides an in-memory Gerrit server, that implements
+// the REST endpoints used by the gerrit package.
+package fake
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gerrit-linter/gerrit"
+)
+
+// xssiPrefix is the prefix that Gerrit puts before JSON responses.
+const xssiPrefix = ")]}'\n"
+
+// Change is a change on the fake server.
+type Change struct {
+	Project string
+	Number  int
+
+	// PatchSets holds the files of each patchset, keyed by
+	// patchset number.
+	PatchSets map[int]map[string]*gerrit.File
+}
+
+// currentPatchSet returns the highest patchset number.
+func (c *Change) currentPatchSet() int {
+	max := 0
+	for ps := range c.PatchSets {
+		if ps > max {
+			max = ps
+		}
+	}
+	return max
+}
+
+type checkKey struct {
+	change   int
+	patchSet int
+	checker  string
+}
+
+type patchSetKey struct {
+	change   int
+	patchSet int
+}
+
+// Server is an in-memory Gerrit server. The zero value is not
+// usable; use New.
+type Server struct {
+	*httptest.Server
+
+	// Latency delays every response.
+	Latency time.Duration
+
+	// Fail, if set, is called for every request. If it returns a
+	// non-zero HTTP status, the request fails with that status.
+	Fail func(req *http.Request) int
+
+	// Authorization, if set, is the Authorization header that
+	// requests for authenticated ("/a/") paths must carry.
+	Authorization string
+
+	// Self is returned for accounts/self.
+	Self gerrit.AccountInfo
+
+	mu       sync.Mutex
+	changes  map[int]*Change
+	checkers map[string]*gerrit.CheckerInfo
+	checks   map[checkKey]*gerrit.CheckInfo
+	reviews  map[patchSetKey][]*gerrit.ReviewInput
+}
+
+// New starts a fake Gerrit server. Call Close when done.
+func New() *Server {
+	s := &Server{
+		Self: gerrit.AccountInfo{
+			AccountID: 1000000,
+			Name:      "Fake Checker",
+			Username:  "checker",
+		},
+		changes:  map[int]*Change{},
+		checkers: map[string]*gerrit.CheckerInfo{},
+		checks:   map[checkKey]*gerrit.CheckInfo{},
+		reviews:  map[patchSetKey][]*gerrit.ReviewInput{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// GerritURL returns the URL of the server, for gerrit.New.
+func (s *Server) GerritURL() url.URL {
+	u, _ := url.Parse(s.URL)
+	return *u
+}
+
+// AddPatchSet adds a patchset with the given files to a change,
+// creating the change if needed.
+func (s *Server) AddPatchSet(project string, change int, patchSet int, files map[string]*gerrit.File) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.changes[change]
+	if c == nil {
+		c = &Change{
+			Project:   project,
+			Number:    change,
+			PatchSets: map[int]map[string]*gerrit.File{},
+		}
+		s.changes[change] = c
+	}
+	c.PatchSets[patchSet] = files
+}
+
+// AddChecker registers a checker.
+func (s *Server) AddChecker(in *gerrit.CheckerInput) *gerrit.CheckerInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.putChecker(in)
+}
+
+// Check returns the check posted for a checker on a patchset, or nil.
+func (s *Server) Check(change int, patchSet int, checkerUUID string) *gerrit.CheckInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.checks[checkKey{change, patchSet, checkerUUID}]
+	if c == nil {
+		return nil
+	}
+	check := *c
+	return &check
+}
+
+// Reviews returns the reviews posted on a patchset, oldest first.
+func (s *Server) Reviews(change int, patchSet int) []*gerrit.ReviewInput {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*gerrit.ReviewInput{}, s.reviews[patchSetKey{change, patchSet}]...)
+}
+
+func (s *Server) putChecker(in *gerrit.CheckerInput) *gerrit.CheckerInfo {
+	now := gerrit.Timestamp(time.Now())
+	info := s.checkers[in.UUID]
+	if info == nil {
+		info = &gerrit.CheckerInfo{
+			UUID:    in.UUID,
+			Created: now,
+		}
+		s.checkers[in.UUID] = info
+	}
+	info.Name = in.Name
+	info.Description = in.Description
+	info.URL = in.URL
+	info.Repository = in.Repository
+	info.Status = in.Status
+	info.Blocking = in.Blocking
+	info.Query = in.Query
+	info.Updated = now
+	return info
+}
+
+// writeJSON sends a JSON response with the XSSI prefix.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(xssiPrefix))
+	w.Write(content)
+}
+
+// readJSON decodes the request body.
+func readJSON(req *http.Request, v interface{}) error {
+	content, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+// splitPath returns the unescaped path segments of a request, without
+// the "a" prefix for authenticated requests.
+func splitPath(req *http.Request) (segments []string, authenticated bool) {
+	for _, seg := range strings.Split(strings.Trim(req.URL.EscapedPath(), "/"), "/") {
+		unescaped, err := url.PathUnescape(seg)
+		if err != nil {
+			unescaped = seg
+		}
+		segments = append(segments, unescaped)
+	}
+	if len(segments) > 0 && segments[0] == "a" {
+		return segments[1:], true
+	}
+	return segments, false
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	if s.Latency > 0 {
+		time.Sleep(s.Latency)
+	}
+	if s.Fail != nil {
+		if code := s.Fail(req); code != 0 {
+			http.Error(w, "injected failure", code)
+			return
+		}
+	}
+
+	segs, authenticated := splitPath(req)
+	if authenticated && s.Authorization != "" && req.Header.Get("Authorization") != s.Authorization {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case len(segs) == 2 && segs[0] == "accounts" && segs[1] == "self":
+		writeJSON(w, &s.Self)
+	case len(segs) >= 3 && segs[0] == "plugins" && segs[1] == "checks" && segs[2] == "checkers":
+		s.serveCheckers(w, req, segs[3:])
+	case len(segs) >= 3 && segs[0] == "plugins" && segs[1] == "checks" && segs[2] == "checks.pending":
+		s.servePending(w, req)
+	case len(segs) == 1 && segs[0] == "changes" && req.Method == "GET":
+		s.serveQuery(w, req)
+	case len(segs) >= 4 && segs[0] == "changes" && segs[2] == "revisions":
+		s.serveRevision(w, req, segs[1], segs[3], segs[4:])
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (s *Server) serveCheckers(w http.ResponseWriter, req *http.Request, rest []string) {
+	uuid := ""
+	if len(rest) > 0 {
+		uuid = rest[0]
+	}
+
+	switch {
+	case req.Method == "GET" && uuid == "":
+		var out []*gerrit.CheckerInfo
+		for _, c := range s.checkers {
+			out = append(out, c)
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i].UUID < out[j].UUID })
+		writeJSON(w, out)
+	case req.Method == "GET":
+		c := s.checkers[uuid]
+		if c == nil {
+			http.NotFound(w, req)
+			return
+		}
+		writeJSON(w, c)
+	case req.Method == "POST":
+		var in gerrit.CheckerInput
+		if err := readJSON(req, &in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if uuid == "" {
+			if _, ok := s.checkers[in.UUID]; ok || in.UUID == "" {
+				http.Error(w, "checker exists", http.StatusConflict)
+				return
+			}
+		} else if _, ok := s.checkers[uuid]; !ok {
+			http.NotFound(w, req)
+			return
+		} else {
+			in.UUID = uuid
+		}
+		writeJSON(w, s.putChecker(&in))
+	case req.Method == "DELETE" && uuid != "":
+		if _, ok := s.checkers[uuid]; !ok {
+			http.NotFound(w, req)
+			return
+		}
+		delete(s.checkers, uuid)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "bad method", http.StatusMethodNotAllowed)
+	}
+}
+
+// servePending answers checks.pending queries of the form
+// "scheme:SCHEME" or "checker:UUID". Checks are pending on the
+// current patchset of changes in the checker's repository, until a
+// state other than NOT_STARTED or SCHEDULED is posted.
+func (s *Server) servePending(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query().Get("query")
+	match := func(c *gerrit.CheckerInfo) bool { return false }
+	switch {
+	case strings.HasPrefix(q, "scheme:"):
+		scheme := strings.TrimPrefix(q, "scheme:") + ":"
+		match = func(c *gerrit.CheckerInfo) bool { return strings.HasPrefix(c.UUID, scheme) }
+	case strings.HasPrefix(q, "checker:"):
+		uuid := strings.TrimPrefix(q, "checker:")
+		match = func(c *gerrit.CheckerInfo) bool { return c.UUID == uuid }
+	default:
+		http.Error(w, "unsupported query", http.StatusBadRequest)
+		return
+	}
+
+	var numbers []int
+	for n := range s.changes {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	out := []*gerrit.PendingChecksInfo{}
+	for _, n := range numbers {
+		ch := s.changes[n]
+		ps := ch.currentPatchSet()
+		pending := map[string]*gerrit.PendingCheckInfo{}
+		for _, c := range s.checkers {
+			if !match(c) || c.Repository != ch.Project || c.Status == "DISABLED" {
+				continue
+			}
+			state := gerrit.StateNotStarted
+			if check := s.checks[checkKey{n, ps, c.UUID}]; check != nil {
+				state = check.State
+			}
+			if state.IsPending() {
+				pending[c.UUID] = &gerrit.PendingCheckInfo{State: state}
+			}
+		}
+		if len(pending) > 0 {
+			out = append(out, &gerrit.PendingChecksInfo{
+				PatchSet: &gerrit.CheckablePatchSetInfo{
+					Repository:   ch.Project,
+					ChangeNumber: n,
+					PatchSetID:   ps,
+				},
+				PendingChecks: pending,
+			})
+		}
+	}
+	writeJSON(w, out)
+}
+
+// serveQuery answers change queries. It supports "status:open", which
+// all changes match, "project:NAME", and "-age:" terms, which all
+// changes pass as they have no timestamps. Changes are returned newest
+// first, in pages of "n" changes starting at "S", and with the current
+// revision for the CURRENT_REVISION option.
+func (s *Server) serveQuery(w http.ResponseWriter, req *http.Request) {
+	v := req.URL.Query()
+	project := ""
+	for _, term := range strings.Fields(v.Get("q")) {
+		switch {
+		case term == "status:open" || strings.HasPrefix(term, "-age:"):
+		case strings.HasPrefix(term, "project:"):
+			project = strings.TrimPrefix(term, "project:")
+		default:
+			http.Error(w, "unsupported query", http.StatusBadRequest)
+			return
+		}
+	}
+	start, _ := strconv.Atoi(v.Get("S"))
+	limit, _ := strconv.Atoi(v.Get("n"))
+	current := false
+	for _, o := range v["o"] {
+		current = current || o == "CURRENT_REVISION"
+	}
+
+	var numbers []int
+	for n, ch := range s.changes {
+		if project == "" || ch.Project == project {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(numbers)))
+
+	out := []*gerrit.ChangeInfo{}
+	for i, n := range numbers {
+		if i < start {
+			continue
+		}
+		if limit > 0 && len(out) == limit {
+			out[len(out)-1].MoreChanges = true
+			break
+		}
+		ch := s.changes[n]
+		info := &gerrit.ChangeInfo{
+			ID:      url.PathEscape(ch.Project) + "~" + strconv.Itoa(n),
+			Project: ch.Project,
+			Status:  "NEW",
+			Number:  n,
+		}
+		if current {
+			ps := ch.currentPatchSet()
+			info.CurrentRevision = strconv.Itoa(ps)
+			info.Revisions = map[string]*gerrit.RevisionInfo{
+				info.CurrentRevision: {Number: ps},
+			}
+		}
+		out = append(out, info)
+	}
+	writeJSON(w, out)
+}
+
+// lookupChange finds a change by number, or by "project~number".
+func (s *Server) lookupChange(id string) *Change {
+	project := ""
+	if idx := strings.LastIndex(id, "~"); idx >= 0 {
+		project, id = id[:idx], id[idx+1:]
+	}
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return nil
+	}
+	c := s.changes[n]
+	if c == nil || (project != "" && project != c.Project) {
+		return nil
+	}
+	return c
+}
+
+func (s *Server) serveRevision(w http.ResponseWriter, req *http.Request, changeID string, revID string, rest []string) {
+	ch := s.lookupChange(changeID)
+	if ch == nil {
+		http.NotFound(w, req)
+		return
+	}
+	ps, err := strconv.Atoi(revID)
+	if revID == "current" {
+		ps, err = ch.currentPatchSet(), nil
+	}
+	files, ok := ch.PatchSets[ps]
+	if err != nil || !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	switch {
+	case len(rest) == 1 && rest[0] == "files" && req.Method == "GET":
+		out := map[string]*gerrit.File{}
+		for name, f := range files {
+			info := *f
+			info.Content = nil
+			if info.Size == 0 {
+				info.Size = len(f.Content)
+			}
+			out[name] = &info
+		}
+		writeJSON(w, out)
+	case len(rest) == 3 && rest[0] == "files" && rest[2] == "content" && req.Method == "GET":
+		f, ok := files[rest[1]]
+		if !ok || f.Status == "D" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(base64.StdEncoding.EncodeToString(f.Content)))
+	case len(rest) == 1 && rest[0] == "review" && req.Method == "POST":
+		var in gerrit.ReviewInput
+		if err := readJSON(req, &in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		key := patchSetKey{ch.Number, ps}
+		s.reviews[key] = append(s.reviews[key], &in)
+		writeJSON(w, &gerrit.ReviewResult{Labels: in.Labels})
+	case len(rest) >= 1 && rest[0] == "checks":
+		s.serveChecks(w, req, ch, ps, rest[1:])
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (s *Server) serveChecks(w http.ResponseWriter, req *http.Request, ch *Change, ps int, rest []string) {
+	switch {
+	case req.Method == "POST" && len(rest) == 0:
+		var in gerrit.CheckInput
+		if err := readJSON(req, &in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		checker := s.checkers[in.CheckerUUID]
+		if checker == nil {
+			http.Error(w, "unknown checker", http.StatusBadRequest)
+			return
+		}
+
+		key := checkKey{ch.Number, ps, in.CheckerUUID}
+		now := gerrit.Timestamp(time.Now())
+		check := s.checks[key]
+		if check == nil {
+			check = &gerrit.CheckInfo{
+				Repository:   ch.Project,
+				ChangeNumber: ch.Number,
+				PatchSetID:   ps,
+				CheckerUUID:  in.CheckerUUID,
+				Created:      now,
+			}
+			s.checks[key] = check
+		}
+		if in.State != "" {
+			check.State = in.State
+		}
+		check.Message = in.Message
+		if in.Started != nil {
+			check.Started = *in.Started
+		}
+		if in.Finished != nil {
+			check.Finished = *in.Finished
+		}
+		check.Updated = now
+		check.CheckerName = checker.Name
+		check.CheckerStatus = checker.Status
+		writeJSON(w, check)
+	case req.Method == "GET" && len(rest) == 0:
+		out := []*gerrit.CheckInfo{}
+		for k, c := range s.checks {
+			if k.change == ch.Number && k.patchSet == ps {
+				out = append(out, c)
+			}
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i].CheckerUUID < out[j].CheckerUUID })
+		writeJSON(w, out)
+	case req.Method == "POST" && len(rest) == 2 && rest[1] == "rerun":
+		checker := s.checkers[rest[0]]
+		if checker == nil {
+			http.NotFound(w, req)
+			return
+		}
+		key := checkKey{ch.Number, ps, rest[0]}
+		now := gerrit.Timestamp(time.Now())
+		check := s.checks[key]
+		if check == nil {
+			check = &gerrit.CheckInfo{
+				Repository:   ch.Project,
+				ChangeNumber: ch.Number,
+				PatchSetID:   ps,
+				CheckerUUID:  rest[0],
+				Created:      now,
+			}
+			s.checks[key] = check
+		}
+		// Rerunning resets the check, like the checks plugin.
+		check.State = gerrit.StateNotStarted
+		check.Message = ""
+		check.Started = gerrit.Timestamp{}
+		check.Finished = gerrit.Timestamp{}
+		check.Updated = now
+		check.CheckerName = checker.Name
+		check.CheckerStatus = checker.Status
+		writeJSON(w, check)
+	case req.Method == "GET" && len(rest) == 1:
+		c := s.checks[checkKey{ch.Number, ps, rest[0]}]
+		if c == nil {
+			http.NotFound(w, req)
+			return
+		}
+		writeJSON(w, c)
+	default:
+		http.NotFound(w, req)
+	}
+}
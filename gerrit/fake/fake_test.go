@@ -0,0 +1,302 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fake
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/gerrit-linter/gerrit"
+)
+
+// newTestServer returns a fake with two changes in repo "r", and
+// checkers "fmt:a" and "fmt:b" on it, and a client for it.
+func newTestServer() (*Server, *gerrit.Server) {
+	s := New()
+	s.AddChecker(&gerrit.CheckerInput{UUID: "fmt:a", Name: "a", Repository: "r", Status: "ENABLED"})
+	s.AddChecker(&gerrit.CheckerInput{UUID: "fmt:b", Name: "b", Repository: "r", Status: "ENABLED"})
+	s.AddChecker(&gerrit.CheckerInput{UUID: "other:c", Name: "c", Repository: "r", Status: "ENABLED"})
+	s.AddPatchSet("r", 1, 1, map[string]*gerrit.File{"a.go": {Content: []byte("package a\n")}})
+	s.AddPatchSet("r", 1, 2, map[string]*gerrit.File{"a.go": {Content: []byte("package b\n")}})
+	s.AddPatchSet("other", 2, 1, map[string]*gerrit.File{})
+
+	g := gerrit.New(s.GerritURL())
+	g.Retry.MaxAttempts = 1
+	return s, g
+}
+
+// pendingCheckers returns the checker UUIDs and states in pending
+// checks, as "project~change/patchset uuid state".
+func pendingCheckers(pending []*gerrit.PendingChecksInfo) []string {
+	var out []string
+	for _, pc := range pending {
+		for uuid, info := range pc.PendingChecks {
+			out = append(out, fmt.Sprintf("%s~%d/%d %s %s", pc.PatchSet.Repository,
+				pc.PatchSet.ChangeNumber, pc.PatchSet.PatchSetID, uuid, info.State))
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestPending(t *testing.T) {
+	s, g := newTestServer()
+	defer s.Close()
+	ctx := context.Background()
+
+	pending, err := g.PendingChecksBySchemeContext(ctx, "fmt")
+	if err != nil {
+		t.Fatalf("PendingChecksByScheme: %v", err)
+	}
+	want := []string{"r~1/2 fmt:a NOT_STARTED", "r~1/2 fmt:b NOT_STARTED"}
+	if got := pendingCheckers(pending); !reflect.DeepEqual(got, want) {
+		t.Errorf("PendingChecksByScheme: got %q, want %q", got, want)
+	}
+
+	pending, err = g.PendingChecksContext(ctx, "fmt:b")
+	if err != nil {
+		t.Fatalf("PendingChecks: %v", err)
+	}
+	want = []string{"r~1/2 fmt:b NOT_STARTED"}
+	if got := pendingCheckers(pending); !reflect.DeepEqual(got, want) {
+		t.Errorf("PendingChecks: got %q, want %q", got, want)
+	}
+
+	// Scheduled checks stay pending; running ones don't.
+	if _, err := g.PostCheckContext(ctx, "1", 2, &gerrit.CheckInput{CheckerUUID: "fmt:a", State: gerrit.StateScheduled}); err != nil {
+		t.Fatalf("PostCheck: %v", err)
+	}
+	if _, err := g.PostCheckContext(ctx, "1", 2, &gerrit.CheckInput{CheckerUUID: "fmt:b", State: gerrit.StateRunning}); err != nil {
+		t.Fatalf("PostCheck: %v", err)
+	}
+	pending, err = g.PendingChecksBySchemeContext(ctx, "fmt")
+	if err != nil {
+		t.Fatalf("PendingChecksByScheme: %v", err)
+	}
+	want = []string{"r~1/2 fmt:a SCHEDULED"}
+	if got := pendingCheckers(pending); !reflect.DeepEqual(got, want) {
+		t.Errorf("PendingChecksByScheme after posting: got %q, want %q", got, want)
+	}
+
+	// Disabled checkers have no pending checks.
+	if _, err := g.UpdateChecker(ctx, "fmt:a", &gerrit.CheckerInput{Name: "a", Repository: "r", Status: "DISABLED"}); err != nil {
+		t.Fatalf("UpdateChecker: %v", err)
+	}
+	pending, err = g.PendingChecksBySchemeContext(ctx, "fmt")
+	if err != nil {
+		t.Fatalf("PendingChecksByScheme: %v", err)
+	}
+	if got := pendingCheckers(pending); len(got) != 0 {
+		t.Errorf("PendingChecksByScheme with disabled checker: got %q", got)
+	}
+}
+
+func TestChecks(t *testing.T) {
+	s, g := newTestServer()
+	defer s.Close()
+	ctx := context.Background()
+
+	started := gerrit.Timestamp(time.Date(2019, 7, 15, 10, 0, 0, 0, time.UTC))
+	finished := gerrit.Timestamp(time.Date(2019, 7, 15, 10, 1, 0, 0, time.UTC))
+	if _, err := g.PostCheckContext(ctx, "r~1", 2, &gerrit.CheckInput{
+		CheckerUUID: "fmt:a",
+		State:       gerrit.StateRunning,
+		Started:     &started,
+	}); err != nil {
+		t.Fatalf("PostCheck: %v", err)
+	}
+	info, err := g.PostCheckContext(ctx, "r~1", 2, &gerrit.CheckInput{
+		CheckerUUID: "fmt:a",
+		State:       gerrit.StateFailed,
+		Message:     "bad",
+		Finished:    &finished,
+	})
+	if err != nil {
+		t.Fatalf("PostCheck: %v", err)
+	}
+	if info.State != gerrit.StateFailed || info.Message != "bad" || info.CheckerName != "a" {
+		t.Errorf("PostCheck: got %+v", info)
+	}
+
+	check := s.Check(1, 2, "fmt:a")
+	if check == nil {
+		t.Fatal("Check: got nil")
+	}
+	if check.State != gerrit.StateFailed || check.Message != "bad" ||
+		!time.Time(check.Started).Equal(time.Time(started)) ||
+		!time.Time(check.Finished).Equal(time.Time(finished)) {
+		t.Errorf("Check: got %+v", check)
+	}
+	if s.Check(1, 1, "fmt:a") != nil {
+		t.Errorf("Check on patchset 1: got a check")
+	}
+
+	got, err := g.GetCheck(ctx, "r~1", 2, "fmt:a", nil)
+	if err != nil {
+		t.Fatalf("GetCheck: %v", err)
+	}
+	if got.State != gerrit.StateFailed || got.CheckerUUID != "fmt:a" || got.PatchSetID != 2 {
+		t.Errorf("GetCheck: got %+v", got)
+	}
+	if _, err := g.GetCheck(ctx, "r~1", 2, "fmt:b", nil); !gerrit.IsNotFound(err) {
+		t.Errorf("GetCheck(fmt:b): got %v, want not found", err)
+	}
+
+	list, err := g.ListChecks(ctx, "r~1", 2, nil)
+	if err != nil {
+		t.Fatalf("ListChecks: %v", err)
+	}
+	if len(list) != 1 || list[0].CheckerUUID != "fmt:a" {
+		t.Errorf("ListChecks: got %+v", list)
+	}
+
+	if _, err := g.PostCheckContext(ctx, "r~1", 2, &gerrit.CheckInput{CheckerUUID: "fmt:x"}); err == nil {
+		t.Errorf("PostCheck for unknown checker: got nil error")
+	}
+}
+
+func TestRerun(t *testing.T) {
+	s, g := newTestServer()
+	defer s.Close()
+	ctx := context.Background()
+
+	for _, st := range []gerrit.CheckState{gerrit.StateRunning, gerrit.StateSuccessful} {
+		if _, err := g.PostCheckContext(ctx, "1", 2, &gerrit.CheckInput{CheckerUUID: "fmt:a", State: st, Message: "ok"}); err != nil {
+			t.Fatalf("PostCheck(%s): %v", st, err)
+		}
+	}
+
+	info, err := g.RerunCheck(ctx, "r~1", 2, "fmt:a", nil)
+	if err != nil {
+		t.Fatalf("RerunCheck: %v", err)
+	}
+	if info.State != gerrit.StateNotStarted || info.Message != "" || !time.Time(info.Finished).IsZero() {
+		t.Errorf("RerunCheck: got %+v", info)
+	}
+	if c := s.Check(1, 2, "fmt:a"); c.State != gerrit.StateNotStarted {
+		t.Errorf("Check after rerun: got state %s", c.State)
+	}
+
+	pending, err := g.PendingChecksContext(ctx, "fmt:a")
+	if err != nil {
+		t.Fatalf("PendingChecks: %v", err)
+	}
+	if got, want := pendingCheckers(pending), []string{"r~1/2 fmt:a NOT_STARTED"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PendingChecks after rerun: got %q, want %q", got, want)
+	}
+
+	// Rerunning a check that never ran creates it.
+	if _, err := g.RerunCheck(ctx, "r~1", 2, "fmt:b", nil); err != nil {
+		t.Fatalf("RerunCheck(fmt:b): %v", err)
+	}
+	if c := s.Check(1, 2, "fmt:b"); c == nil || c.State != gerrit.StateNotStarted {
+		t.Errorf("Check(fmt:b) after rerun: got %+v", c)
+	}
+
+	if _, err := g.RerunCheck(ctx, "r~1", 2, "fmt:x", nil); !gerrit.IsNotFound(err) {
+		t.Errorf("RerunCheck for unknown checker: got %v, want not found", err)
+	}
+}
+
+func TestReview(t *testing.T) {
+	s, g := newTestServer()
+	defer s.Close()
+
+	in := &gerrit.ReviewInput{
+		Message: "Formatting",
+		Labels:  map[string]int{"Code-Style": -1},
+	}
+	out, err := g.SetReview(context.Background(), "r~1", "2", in)
+	if err != nil {
+		t.Fatalf("SetReview: %v", err)
+	}
+	if out.Labels["Code-Style"] != -1 {
+		t.Errorf("SetReview: got %+v", out)
+	}
+
+	reviews := s.Reviews(1, 2)
+	if len(reviews) != 1 || !reflect.DeepEqual(reviews[0], in) {
+		t.Errorf("Reviews: got %+v", reviews)
+	}
+	if got := s.Reviews(1, 1); len(got) != 0 {
+		t.Errorf("Reviews on patchset 1: got %+v", got)
+	}
+}
+
+func TestQueryAllChanges(t *testing.T) {
+	s, g := newTestServer()
+	defer s.Close()
+	s.AddPatchSet("r", 3, 1, map[string]*gerrit.File{})
+	ctx := context.Background()
+
+	var starts []string
+	s.Fail = func(req *http.Request) int {
+		starts = append(starts, req.URL.Query().Get("S"))
+		return 0
+	}
+	changes, err := g.QueryAllChanges(ctx, "status:open", &gerrit.QueryOptions{
+		Options: []string{"CURRENT_REVISION"},
+		Limit:   1,
+	})
+	if err != nil {
+		t.Fatalf("QueryAllChanges: %v", err)
+	}
+	var got []string
+	for _, c := range changes {
+		got = append(got, fmt.Sprintf("%s~%d/%d", c.Project, c.Number, c.CurrentRevisionInfo().Number))
+	}
+	if want := []string{"r~3/1", "other~2/1", "r~1/2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("QueryAllChanges: got %q, want %q", got, want)
+	}
+	if want := []string{"", "1", "2"}; !reflect.DeepEqual(starts, want) {
+		t.Errorf("QueryAllChanges: got pages starting at %q, want %q", starts, want)
+	}
+
+	page, err := g.QueryChanges(ctx, "status:open project:r", &gerrit.QueryOptions{Limit: 1})
+	if err != nil {
+		t.Fatalf("QueryChanges: %v", err)
+	}
+	if len(page) != 1 || page[0].Number != 3 || !page[0].MoreChanges {
+		t.Errorf("QueryChanges(project:r): got %v, want change 3 with more changes", page)
+	}
+
+	if _, err := g.QueryChanges(ctx, "owner:self", nil); gerrit.StatusCode(err) != http.StatusBadRequest {
+		t.Errorf("QueryChanges(owner:self): got %v, want 400", err)
+	}
+}
+
+func TestFilesAndFailures(t *testing.T) {
+	s, g := newTestServer()
+	defer s.Close()
+	ctx := context.Background()
+
+	ch, err := g.GetChangeContext(ctx, "r~1", "2")
+	if err != nil {
+		t.Fatalf("GetChange: %v", err)
+	}
+	if got := string(ch.Files["a.go"].Content); got != "package b\n" {
+		t.Errorf("a.go: got %q", got)
+	}
+
+	s.Fail = func(*http.Request) int { return http.StatusNotFound }
+	if _, err := g.GetChangeContext(ctx, "r~1", "2"); !gerrit.IsNotFound(err) {
+		t.Errorf("GetChange with injected failure: got %v, want not found", err)
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gerrit
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+)
+
+// ErrTooLarge is returned when the contents of a change exceed the
+// size budget in FetchOptions.
+var ErrTooLarge = errors.New("change exceeds size budget")
+
+// FetchOptions configures how GetChange retrieves file contents.
+type FetchOptions struct {
+	// Parallelism is the number of concurrent content
+	// requests. Values below 1 fetch files one at a time.
+	Parallelism int
+
+	// MaxTotalSize, if positive, limits the summed size of the
+	// file contents of a change.
+	MaxTotalSize int64
+
+	// Archive retrieves all contents in a single request, using
+	// the revision's archive endpoint. Files missing from the
+	// archive, such as /COMMIT_MSG, are fetched individually. If
+	// MaxTotalSize is set, at most that many bytes of the
+	// compressed archive are read, and the files not found by then are
+	// fetched individually too.
+	Archive bool
+}
+
+// sizeBudget tracks the bytes fetched against FetchOptions.MaxTotalSize.
+type sizeBudget struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+}
+
+// take accounts for n more bytes.
+func (b *sizeBudget) take(n int64) error {
+	if b.limit <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used += n
+	if b.used > b.limit {
+		return fmt.Errorf("%d bytes > %d: %w", b.used, b.limit, ErrTooLarge)
+	}
+	return nil
+}
+
+// errArchiveTooLarge is returned by fetchArchive when the archive
+// exceeds FetchOptions.MaxTotalSize.
+var errArchiveTooLarge = errors.New("archive exceeds size budget")
+
+// limitReader reads up to n bytes from r, and then fails with err
+// unless r is exhausted.
+type limitReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		var b [1]byte
+		if n, err := l.r.Read(b[:]); n == 0 && err != nil {
+			return 0, err
+		}
+		return 0, l.err
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// fetchContents fills in the contents of all files that were not
+// deleted.
+func (g *Server) fetchContents(ctx context.Context, changeID string, revID string, files map[string]*File) error {
+	budget := &sizeBudget{limit: g.Fetch.MaxTotalSize}
+	if budget.limit > 0 {
+		var total int64
+		for _, f := range files {
+			if f.Status != "D" {
+				total += int64(f.Size)
+			}
+		}
+		if total > budget.limit {
+			return fmt.Errorf("change %s: %d bytes > %d: %w", changeID, total, budget.limit, ErrTooLarge)
+		}
+	}
+
+	todo := map[string]*File{}
+	for name, f := range files {
+		if f.Status != "D" {
+			todo[name] = f
+		}
+	}
+
+	if g.Fetch.Archive {
+		err := g.fetchArchive(ctx, changeID, revID, todo, budget)
+		if errors.Is(err, errArchiveTooLarge) {
+			log.Printf("change %s: %v; fetching %d files individually", changeID, err, len(todo))
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return g.fetchParallel(ctx, changeID, revID, todo, budget)
+}
+
+// fetchParallel fetches the given files with up to
+// FetchOptions.Parallelism concurrent requests.
+func (g *Server) fetchParallel(ctx context.Context, changeID string, revID string, files map[string]*File, budget *sizeBudget) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	n := g.Fetch.Parallelism
+	if n < 1 {
+		n = 1
+	}
+	sem := make(chan struct{}, n)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for name, f := range files {
+		name, f := name, f
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			// A fetch failed, or the caller gave up.
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			c, err := g.GetContentContext(ctx, changeID, revID, name)
+			if err == nil {
+				err = budget.take(int64(len(c)))
+			}
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+				return
+			}
+			f.Content = c
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	// Only set if the parent context is done, as cancel() was
+	// not called yet.
+	return ctx.Err()
+}
+
+// fetchArchive downloads the revision as a gzipped tarball, and fills
+// in the content of the files it contains. The found files are
+// removed from the map.
+func (g *Server) fetchArchive(ctx context.Context, changeID string, revID string, files map[string]*File, budget *sizeBudget) error {
+	u := g.pathURL(fmt.Sprintf("changes/%s/revisions/%s/archive",
+		url.PathEscape(changeID), revID))
+	u.RawQuery = "format=tgz"
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	rep, err := g.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer rep.Body.Close()
+	if rep.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(rep.Body, maxErrorBody))
+		return newError("GET", u.String(), rep, body)
+	}
+
+	var body io.Reader = rep.Body
+	if limit := g.Fetch.MaxTotalSize; limit > 0 {
+		body = &limitReader{r: rep.Body, n: limit, err: errArchiveTooLarge}
+	}
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for len(files) > 0 {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		name := path.Clean(hdr.Name)
+		f, ok := files[name]
+		if !ok {
+			continue
+		}
+
+		var content []byte
+		switch {
+		case hdr.Typeflag == tar.TypeSymlink:
+			content = []byte(hdr.Linkname)
+		case hdr.FileInfo().Mode().IsRegular():
+			if err := budget.take(hdr.Size); err != nil {
+				return err
+			}
+			content, err = ioutil.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+		default:
+			continue
+		}
+
+		f.Content = content
+		delete(files, name)
+	}
+	return nil
+}
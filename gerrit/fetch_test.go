@@ -0,0 +1,244 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gerrit
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLimitReader(t *testing.T) {
+	errLimit := errors.New("limit")
+	for _, tc := range []struct {
+		in      string
+		n       int64
+		wantErr error
+	}{
+		{"abc", 4, nil},
+		{"abc", 3, nil},
+		{"abc", 2, errLimit},
+		{"", 0, nil},
+	} {
+		got, err := ioutil.ReadAll(&limitReader{r: strings.NewReader(tc.in), n: tc.n, err: errLimit})
+		if err != tc.wantErr {
+			t.Errorf("read %q with limit %d: got err %v, want %v", tc.in, tc.n, err, tc.wantErr)
+		}
+		if err == nil && string(got) != tc.in {
+			t.Errorf("read %q with limit %d: got %q", tc.in, tc.n, got)
+		}
+	}
+}
+
+// newTestServer returns a Server talking to h, without retries.
+func newTestServer(t *testing.T, h http.HandlerFunc) (*Server, *httptest.Server) {
+	ts := httptest.NewServer(h)
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		ts.Close()
+		t.Fatal(err)
+	}
+	g := New(*u)
+	g.Retry.MaxAttempts = 1
+	return g, ts
+}
+
+func tgz(t *testing.T, files map[string]string, order []string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, name := range order {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(files[name])),
+			Typeflag: tar.TypeReg,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFetchArchiveTooLarge(t *testing.T) {
+	// Random bytes, so the archive doesn't compress below the limit.
+	rnd := rand.New(rand.NewSource(1))
+	buf := make([]byte, 1000)
+	rnd.Read(buf)
+	big := string(buf)
+	archive := tgz(t, map[string]string{
+		"big.txt": big,
+		"a.go":    "package a\n",
+	}, []string{"big.txt", "a.go"})
+
+	var contentRequests int32
+	g, ts := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/archive"):
+			w.Write(archive)
+		case strings.HasSuffix(r.URL.Path, "/a.go/content"):
+			atomic.AddInt32(&contentRequests, 1)
+			w.Write([]byte(base64.StdEncoding.EncodeToString([]byte("package a\n"))))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	defer ts.Close()
+	g.Fetch = FetchOptions{Archive: true, MaxTotalSize: 100}
+
+	files := map[string]*File{"a.go": {Size: 10}}
+	if err := g.fetchContents(context.Background(), "p~1", "1", files); err != nil {
+		t.Fatalf("fetchContents: %v", err)
+	}
+	if got := string(files["a.go"].Content); got != "package a\n" {
+		t.Errorf("a.go: got %q", got)
+	}
+	if contentRequests != 1 {
+		t.Errorf("got %d content requests, want 1", contentRequests)
+	}
+}
+
+func TestFetchArchive(t *testing.T) {
+	archive := tgz(t, map[string]string{
+		"b.go": "package b\n",
+		"a.go": "package a\n",
+	}, []string{"b.go", "a.go"})
+	g, ts := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/archive") {
+			w.Write(archive)
+			return
+		}
+		t.Errorf("unexpected request %s", r.URL)
+		http.NotFound(w, r)
+	})
+	defer ts.Close()
+	g.Fetch = FetchOptions{Archive: true, MaxTotalSize: 1000}
+
+	files := map[string]*File{"a.go": {Size: 10}}
+	if err := g.fetchContents(context.Background(), "p~1", "1", files); err != nil {
+		t.Fatalf("fetchContents: %v", err)
+	}
+	if got := string(files["a.go"].Content); got != "package a\n" {
+		t.Errorf("a.go: got %q", got)
+	}
+}
+
+func TestFetchParallelStopsOnError(t *testing.T) {
+	var requests int32
+	g, ts := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.NotFound(w, r)
+	})
+	defer ts.Close()
+	g.Fetch = FetchOptions{Parallelism: 1}
+
+	files := map[string]*File{}
+	for _, n := range []string{"a", "b", "c", "d", "e"} {
+		files[n] = &File{}
+	}
+	if err := g.fetchContents(context.Background(), "p~1", "1", files); err == nil {
+		t.Fatal("fetchContents: got nil error")
+	}
+	if requests != 1 {
+		t.Errorf("got %d requests after the first failure, want 1", requests)
+	}
+}
+
+func TestFetchParallelCanceled(t *testing.T) {
+	g, ts := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request %s", r.URL)
+	})
+	defer ts.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	files := map[string]*File{"a": {}, "b": {}}
+	if err := g.fetchContents(ctx, "p~1", "1", files); err != context.Canceled {
+		t.Errorf("fetchContents: got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestBaseFetcherMerge(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		parents string
+		want    string
+	}{
+		{"ordinary", `[{"commit":"p1"}]`, "parent 1 content\n"},
+		{"merge", `[{"commit":"p1"},{"commit":"p2"}]`, "common\nauto-merge\ntail\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			commits := 0
+			g, ts := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/changes/r~1/revisions/2/commit":
+					commits++
+					w.Write([]byte(")]}'\n{\"parents\":" + tc.parents + "}"))
+				case "/changes/r~1/revisions/2/files/old.txt/content":
+					if r.URL.Query().Get("parent") != "1" {
+						http.Error(w, "want parent=1", http.StatusBadRequest)
+						return
+					}
+					w.Write([]byte(base64.StdEncoding.EncodeToString([]byte("parent 1 content\n"))))
+				case "/changes/r~1/revisions/2/files/new.txt/diff":
+					if r.URL.Query().Get("context") != "ALL" {
+						http.Error(w, "want context=ALL", http.StatusBadRequest)
+						return
+					}
+					w.Write([]byte(`)]}'
+{"content":[{"ab":["common"]},{"a":["auto-merge"],"b":["resolved"]},{"ab":["tail"]}]}`))
+				default:
+					http.NotFound(w, r)
+				}
+			})
+			defer ts.Close()
+
+			files := map[string]*File{"new.txt": {Status: "R", OldPath: "old.txt"}}
+			c := &Change{Files: files, base: g.baseFetcher("r~1", "2", 0, files)}
+			for i := 0; i < 2; i++ {
+				got, err := c.base(context.Background(), "old.txt")
+				if err != nil {
+					t.Fatalf("base: %v", err)
+				}
+				if string(got) != tc.want {
+					t.Errorf("base: got %q, want %q", got, tc.want)
+				}
+			}
+			if commits != 1 {
+				t.Errorf("fetched the commit %d times, want 1", commits)
+			}
+		})
+	}
+}
@@ -0,0 +1,548 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gerrit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChangeSource retrieves the files of a change. Server implements it
+// with REST calls.
+type ChangeSource interface {
+	// GetChangeContext returns the Change (including file contents)
+	// for a given change.
+	GetChangeContext(ctx context.Context, changeID string, revID string) (*Change, error)
+
+	// GetContentContext returns the content of a file at the given
+	// revision.
+	GetContentContext(ctx context.Context, changeID string, revID string, fileID string) ([]byte, error)
+}
+
+var _ = (ChangeSource)((*Server)(nil))
+
+// parentChangeSource is a ChangeSource that can compare against a
+// chosen parent.
+type parentChangeSource interface {
+	GetChangeParentContext(ctx context.Context, changeID string, revID string, parent int) (*Change, error)
+}
+
+var _ = (parentChangeSource)((*Server)(nil))
+
+// commitMsgFile is the magic file that holds the commit message.
+const commitMsgFile = "/COMMIT_MSG"
+
+// GitMirror reads changes from local bare repositories, fetching
+// patchset refs with the git command line tool. Changes must be
+// addressed as "project~number", and revisions by patchset number.
+type GitMirror struct {
+	// Dir holds a bare repository per project.
+	Dir string
+
+	// Remote is the base URL of the git host. The project name is
+	// appended to it to form the remote for a project.
+	Remote url.URL
+
+	// Git is the git binary to use. Defaults to "git".
+	Git string
+
+	// Fallback, if set, serves requests that fail in the mirror.
+	Fallback ChangeSource
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+var _ = (ChangeSource)((*GitMirror)(nil))
+
+// NewGitMirror creates a mirror rooted at dir, that fetches from the
+// given remote.
+func NewGitMirror(dir string, remote url.URL) *GitMirror {
+	return &GitMirror{
+		Dir:    dir,
+		Remote: remote,
+		Git:    "git",
+	}
+}
+
+// lock returns the lock for a project's repository.
+func (m *GitMirror) lock(project string) *sync.Mutex {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.locks == nil {
+		m.locks = map[string]*sync.Mutex{}
+	}
+	l := m.locks[project]
+	if l == nil {
+		l = &sync.Mutex{}
+		m.locks[project] = l
+	}
+	return l
+}
+
+// git runs a git command in the given repository, and returns its
+// standard output.
+func (m *GitMirror) git(ctx context.Context, dir string, stdin io.Reader, args ...string) ([]byte, error) {
+	bin := m.Git
+	if bin == "" {
+		bin = "git"
+	}
+	cmd := exec.CommandContext(ctx, bin, append([]string{"--git-dir=" + dir}, args...)...)
+	cmd.Stdin = stdin
+	var out, errBuf bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &errBuf
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("git %s: %v, stderr %s", strings.Join(args, " "), err, errBuf.String())
+	}
+	return out.Bytes(), nil
+}
+
+// checkProjectName returns an error for project names that could name
+// a directory outside the mirror. Project names may come from
+// webhook requests.
+func checkProjectName(project string) error {
+	if project == "" || path.IsAbs(project) || filepath.IsAbs(filepath.FromSlash(project)) {
+		return fmt.Errorf("project %q: want a relative name", project)
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(project), "/") {
+		if elem == ".." {
+			return fmt.Errorf("project %q: must not contain ..", project)
+		}
+	}
+	return nil
+}
+
+// fetch makes sure the patchset ref is present in the mirror, and
+// returns the repository directory and the ref.
+func (m *GitMirror) fetch(ctx context.Context, changeID string, revID string) (dir string, ref string, err error) {
+	idx := strings.LastIndex(changeID, "~")
+	if idx < 0 {
+		return "", "", fmt.Errorf("change %q: want project~number", changeID)
+	}
+	project := changeID[:idx]
+	if err := checkProjectName(project); err != nil {
+		return "", "", err
+	}
+	num, err := strconv.Atoi(changeID[idx+1:])
+	if err != nil {
+		return "", "", fmt.Errorf("change %q: %v", changeID, err)
+	}
+	ps, err := strconv.Atoi(revID)
+	if err != nil {
+		return "", "", fmt.Errorf("revision %q: want patchset number", revID)
+	}
+
+	dir = filepath.Join(m.Dir, filepath.FromSlash(project)+".git")
+	ref = fmt.Sprintf("refs/changes/%02d/%d/%d", num%100, num, ps)
+
+	l := m.lock(project)
+	l.Lock()
+	defer l.Unlock()
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", "", err
+		}
+		if _, err := m.git(ctx, dir, nil, "init", "--quiet", "--bare"); err != nil {
+			return "", "", err
+		}
+	}
+
+	// Patchset refs never change, so a ref that is present is up to date.
+	if _, err := m.git(ctx, dir, nil, "rev-parse", "--verify", "--quiet", ref+"^{commit}"); err == nil {
+		return dir, ref, nil
+	}
+
+	remote := m.Remote
+	remote.Path = path.Join(remote.Path, project)
+	if _, err := m.git(ctx, dir, nil, "fetch", "--quiet", "--no-tags", remote.String(), "+"+ref+":"+ref); err != nil {
+		return "", "", err
+	}
+	return dir, ref, nil
+}
+
+// catFile reads objects with "git cat-file --batch". Missing objects
+// are returned as nil.
+func (m *GitMirror) catFile(ctx context.Context, dir string, objs []string) ([][]byte, error) {
+	in := strings.Join(objs, "\n") + "\n"
+	out, err := m.git(ctx, dir, strings.NewReader(in), "cat-file", "--batch")
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(bytes.NewReader(out))
+	var result [][]byte
+	for range objs {
+		hdr, err := r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("cat-file: %v", err)
+		}
+		fields := strings.Fields(hdr)
+		if len(fields) != 3 {
+			// "<obj> missing" or "<obj> ambiguous".
+			result = append(result, nil)
+			continue
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("cat-file header %q: %v", hdr, err)
+		}
+		content := make([]byte, size+1)
+		if _, err := io.ReadFull(r, content); err != nil {
+			return nil, fmt.Errorf("cat-file: %v", err)
+		}
+		result = append(result, content[:size])
+	}
+	return result, nil
+}
+
+// commitMessage extracts the message from a raw commit object.
+func commitMessage(commit []byte) []byte {
+	if idx := bytes.Index(commit, []byte("\n\n")); idx >= 0 {
+		return commit[idx+2:]
+	}
+	return nil
+}
+
+// commitHeader returns the values of a header field in a raw commit
+// object.
+func commitHeader(commit []byte, field string) []string {
+	var vals []string
+	for _, l := range strings.Split(string(commit), "\n") {
+		if l == "" {
+			break
+		}
+		if strings.HasPrefix(l, field+" ") {
+			vals = append(vals, l[len(field)+1:])
+		}
+	}
+	return vals
+}
+
+// shortMessage returns the first paragraph of a commit message as a
+// single line, like JGit's RevCommit.getShortMessage.
+func shortMessage(msg []byte) string {
+	s := string(msg)
+	if idx := strings.Index(s, "\n\n"); idx >= 0 {
+		s = s[:idx]
+	}
+	s = strings.TrimRight(s, "\n")
+	s = strings.Replace(s, "\r\n", " ", -1)
+	return strings.Replace(s, "\n", " ", -1)
+}
+
+// formatIdent formats an "author" or "committer" header value, eg.
+// "A U Thor <author@example.com> 1563178021 +0200", as the two lines
+// Gerrit puts in /COMMIT_MSG.
+func formatIdent(field, ident string) string {
+	who, when := ident, ""
+	if idx := strings.LastIndex(ident, ">"); idx >= 0 {
+		who, when = ident[:idx+1], strings.TrimSpace(ident[idx+1:])
+	}
+	line := fmt.Sprintf("%s:     %s\n", field, who)
+
+	fields := strings.Fields(when)
+	if len(fields) != 2 {
+		return line
+	}
+	secs, err1 := strconv.ParseInt(fields[0], 10, 64)
+	tz, err2 := strconv.Atoi(fields[1])
+	if err1 != nil || err2 != nil {
+		return line
+	}
+	offset := (tz/100*60 + tz%100) * 60
+	t := time.Unix(secs, 0).In(time.FixedZone("", offset))
+	return line + fmt.Sprintf("%sDate: %s\n", field, t.Format("2006-01-02 15:04:05 -0700"))
+}
+
+// commitMsgContent returns the content of /COMMIT_MSG for a raw commit
+// object, as Gerrit formats it: the parents, author and committer,
+// followed by the message. Parents are abbreviated to 8 hex digits;
+// Gerrit uses longer ones if that is ambiguous in its repository.
+func (m *GitMirror) commitMsgContent(ctx context.Context, dir string, commit []byte) ([]byte, error) {
+	parents := commitHeader(commit, "parent")
+	var parentCommits [][]byte
+	if len(parents) > 0 {
+		var err error
+		parentCommits, err = m.catFile(ctx, dir, parents)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var b bytes.Buffer
+	for i, p := range parents {
+		switch {
+		case len(parents) == 1:
+			b.WriteString("Parent:     ")
+		case i == 0:
+			b.WriteString("Merge Of:   ")
+		default:
+			b.WriteString("            ")
+		}
+		abbrev := p
+		if len(abbrev) > 8 {
+			abbrev = abbrev[:8]
+		}
+		fmt.Fprintf(&b, "%s (%s)\n", abbrev, shortMessage(commitMessage(parentCommits[i])))
+	}
+	for _, f := range []struct{ header, field string }{
+		{"author", "Author"},
+		{"committer", "Commit"},
+	} {
+		if v := commitHeader(commit, f.header); len(v) > 0 {
+			b.WriteString(formatIdent(f.field, v[0]))
+		}
+	}
+	b.WriteString("\n")
+	b.Write(commitMessage(commit))
+	return b.Bytes(), nil
+}
+
+// gitStatus maps git's raw diff status onto Gerrit's file status.
+func gitStatus(s string) string {
+	switch s[0] {
+	case 'A', 'D', 'R', 'C':
+		return s[:1]
+	}
+	return ""
+}
+
+// diffEntry is a single record of "git diff-tree --raw" output.
+type diffEntry struct {
+	name    string
+	oldName string
+	oldMode int
+	newMode int
+	oldSHA  string
+	newSHA  string
+	status  string
+}
+
+// diffTree returns the files changed by the commit against the given
+// 1-based parent.
+func (m *GitMirror) diffTree(ctx context.Context, dir string, ref string, parent int) ([]diffEntry, error) {
+	args := []string{"diff-tree", "-r", "-z", "-M", "--raw", "--no-commit-id"}
+	parentRef := ref + "^" + strconv.Itoa(parent)
+	if _, err := m.git(ctx, dir, nil, "rev-parse", "--verify", "--quiet", parentRef); err == nil {
+		args = append(args, parentRef, ref)
+	} else if parent > 1 {
+		return nil, fmt.Errorf("%s: no parent %d", ref, parent)
+	} else {
+		args = append(args, "--root", ref)
+	}
+	out, err := m.git(ctx, dir, nil, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+	var entries []diffEntry
+	for i := 0; i < len(fields); i++ {
+		if fields[i] == "" {
+			continue
+		}
+		// :oldmode newmode oldsha newsha status
+		meta := strings.Fields(strings.TrimPrefix(fields[i], ":"))
+		if len(meta) != 5 {
+			return nil, fmt.Errorf("diff-tree: bad record %q", fields[i])
+		}
+		e := diffEntry{
+			oldSHA: meta[2],
+			newSHA: meta[3],
+			status: gitStatus(meta[4]),
+		}
+		oldMode, err1 := strconv.ParseInt(meta[0], 8, 32)
+		newMode, err2 := strconv.ParseInt(meta[1], 8, 32)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("diff-tree: bad modes in %q", fields[i])
+		}
+		e.oldMode, e.newMode = int(oldMode), int(newMode)
+
+		i++
+		if e.status == "R" || e.status == "C" {
+			if i < len(fields) {
+				e.oldName = fields[i]
+			}
+			i++
+		}
+		if i >= len(fields) {
+			return nil, fmt.Errorf("diff-tree: truncated output")
+		}
+		e.name = fields[i]
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// isBinary applies git's heuristic: content with a NUL byte in its
+// first 8000 bytes is binary.
+func isBinary(content []byte) bool {
+	if len(content) > 8000 {
+		content = content[:8000]
+	}
+	return bytes.IndexByte(content, 0) >= 0
+}
+
+// GetChangeContext returns the Change (including file contents) for a
+// given change.
+func (m *GitMirror) GetChangeContext(ctx context.Context, changeID string, revID string) (*Change, error) {
+	return m.GetChangeParentContext(ctx, changeID, revID, 0)
+}
+
+// GetChangeParentContext returns the Change (including file contents)
+// for a given change, with the files compared against the given
+// 1-based parent. Parent 0 selects the first parent; unlike on
+// Gerrit, merges are not compared against their auto-merge.
+func (m *GitMirror) GetChangeParentContext(ctx context.Context, changeID string, revID string, parent int) (*Change, error) {
+	ch, err := m.getChange(ctx, changeID, revID, parent)
+	if err != nil && m.Fallback != nil {
+		log.Printf("git mirror: %v; using fallback", err)
+		if s, ok := m.Fallback.(parentChangeSource); ok {
+			return s.GetChangeParentContext(ctx, changeID, revID, parent)
+		}
+		return m.Fallback.GetChangeContext(ctx, changeID, revID)
+	}
+	return ch, err
+}
+
+func (m *GitMirror) getChange(ctx context.Context, changeID string, revID string, parent int) (*Change, error) {
+	dir, ref, err := m.fetch(ctx, changeID, revID)
+	if err != nil {
+		return nil, err
+	}
+	baseParent := parent
+	if baseParent == 0 {
+		baseParent = 1
+	}
+	entries, err := m.diffTree(ctx, dir, ref, baseParent)
+	if err != nil {
+		return nil, err
+	}
+
+	objs := []string{ref}
+	var names []string
+	for _, e := range entries {
+		if e.status != "D" {
+			objs = append(objs, e.newSHA)
+			names = append(names, e.name)
+		}
+	}
+	contents, err := m.catFile(ctx, dir, objs)
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string]*File{}
+	oldSHAs := map[string]string{}
+	msg, err := m.commitMsgContent(ctx, dir, contents[0])
+	if err != nil {
+		return nil, err
+	}
+	files[commitMsgFile] = &File{
+		Status:  "A",
+		NewMode: 0100644,
+		Size:    len(msg),
+		Content: msg,
+	}
+	for _, e := range entries {
+		files[e.name] = &File{
+			Status:  e.status,
+			OldPath: e.oldName,
+			OldMode: e.oldMode,
+			NewMode: e.newMode,
+		}
+		old := e.name
+		if e.oldName != "" {
+			old = e.oldName
+		}
+		oldSHAs[old] = e.oldSHA
+	}
+	for i, n := range names {
+		// Gitlinks point to commits that are not in the
+		// mirror, so their content is nil.
+		f := files[n]
+		f.Content = contents[i+1]
+		f.Size = len(f.Content)
+		f.Binary = isBinary(f.Content)
+	}
+
+	return &Change{
+		Files:  files,
+		Parent: parent,
+		base: func(ctx context.Context, name string) ([]byte, error) {
+			obj, ok := oldSHAs[name]
+			if !ok {
+				obj = fmt.Sprintf("%s^%d:%s", ref, baseParent, name)
+			}
+			contents, err := m.catFile(ctx, dir, []string{obj})
+			if err != nil {
+				return nil, err
+			}
+			if contents[0] == nil {
+				return nil, ErrNotFound
+			}
+			return contents[0], nil
+		},
+	}, nil
+}
+
+// GetContentContext returns the content of a file at the given
+// revision.
+func (m *GitMirror) GetContentContext(ctx context.Context, changeID string, revID string, fileID string) ([]byte, error) {
+	c, err := m.getContent(ctx, changeID, revID, fileID)
+	if err != nil && err != ErrNotFound && m.Fallback != nil {
+		log.Printf("git mirror: %v; using fallback", err)
+		return m.Fallback.GetContentContext(ctx, changeID, revID, fileID)
+	}
+	return c, err
+}
+
+func (m *GitMirror) getContent(ctx context.Context, changeID string, revID string, fileID string) ([]byte, error) {
+	dir, ref, err := m.fetch(ctx, changeID, revID)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := ref + ":" + fileID
+	if fileID == commitMsgFile {
+		obj = ref
+	}
+	contents, err := m.catFile(ctx, dir, []string{obj})
+	if err != nil {
+		return nil, err
+	}
+	if contents[0] == nil {
+		return nil, ErrNotFound
+	}
+	if fileID == commitMsgFile {
+		return m.commitMsgContent(ctx, dir, contents[0])
+	}
+	return contents[0], nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gerrit
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestRemote creates a repository with a change 1 of two commits,
+// and returns its directory and the sha of the first commit.
+func newTestRemote(t *testing.T, dir string) (string, string) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	remote := filepath.Join(dir, "remote", "proj")
+	git := func(env []string, args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = remote
+		cmd.Env = append(os.Environ(), env...)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s: %v, %s", strings.Join(args, " "), err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	if err := os.MkdirAll(remote, 0755); err != nil {
+		t.Fatal(err)
+	}
+	git(nil, "init", "--quiet")
+	env := []string{
+		"GIT_AUTHOR_NAME=A U Thor",
+		"GIT_AUTHOR_EMAIL=author@example.com",
+		"GIT_AUTHOR_DATE=1563178021 +0200",
+		"GIT_COMMITTER_NAME=C O Mitter",
+		"GIT_COMMITTER_EMAIL=committer@example.com",
+		"GIT_COMMITTER_DATE=1563181621 -0130",
+	}
+	if err := ioutil.WriteFile(filepath.Join(remote, "a.txt"), []byte("a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git(env, "add", "a.txt")
+	git(env, "commit", "--quiet", "-m", "Initial\nimport\n\nBody.")
+	first := git(nil, "rev-parse", "HEAD")
+
+	if err := ioutil.WriteFile(filepath.Join(remote, "b.txt"), []byte("b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git(env, "add", "b.txt")
+	git(env, "commit", "--quiet", "-m", "Add b\n\nChange-Id: I0123")
+	git(nil, "update-ref", "refs/changes/01/1/1", "HEAD")
+	return filepath.Join(dir, "remote"), first
+}
+
+func TestGitMirrorCommitMsg(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitmirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	remote, first := newTestRemote(t, dir)
+	m := NewGitMirror(filepath.Join(dir, "mirror"), url.URL{Scheme: "file", Path: remote})
+
+	want := "Parent:     " + first[:8] + " (Initial import)\n" +
+		"Author:     A U Thor <author@example.com>\n" +
+		"AuthorDate: 2019-07-15 10:07:01 +0200\n" +
+		"Commit:     C O Mitter <committer@example.com>\n" +
+		"CommitDate: 2019-07-15 07:37:01 -0130\n" +
+		"\n" +
+		"Add b\n\nChange-Id: I0123\n"
+
+	ctx := context.Background()
+	got, err := m.GetContentContext(ctx, "proj~1", "1", commitMsgFile)
+	if err != nil {
+		t.Fatalf("GetContentContext: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("GetContentContext(%s): got\n%s\nwant\n%s", commitMsgFile, got, want)
+	}
+
+	ch, err := m.GetChangeContext(ctx, "proj~1", "1")
+	if err != nil {
+		t.Fatalf("GetChangeContext: %v", err)
+	}
+	if got := string(ch.Files[commitMsgFile].Content); got != want {
+		t.Errorf("GetChangeContext: %s: got\n%s\nwant\n%s", commitMsgFile, got, want)
+	}
+	if got := string(ch.Files["b.txt"].Content); got != "b\n" {
+		t.Errorf("GetChangeContext: b.txt: got %q", got)
+	}
+}
+
+func TestFormatIdent(t *testing.T) {
+	for _, tc := range []struct {
+		ident string
+		want  string
+	}{
+		{"A <a@x> 0 +0000", "Author:     A <a@x>\nAuthorDate: 1970-01-01 00:00:00 +0000\n"},
+		{"A <a@x> 3600 +0100", "Author:     A <a@x>\nAuthorDate: 1970-01-01 02:00:00 +0100\n"},
+		{"A <a@x> 3600 -0030", "Author:     A <a@x>\nAuthorDate: 1970-01-01 00:30:00 -0030\n"},
+		{"A <a@x>", "Author:     A <a@x>\n"},
+	} {
+		if got := formatIdent("Author", tc.ident); got != tc.want {
+			t.Errorf("formatIdent(%q): got %q, want %q", tc.ident, got, tc.want)
+		}
+	}
+}
+
+func TestGitMirrorProjectName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitmirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mirror := filepath.Join(dir, "a", "mirror")
+	m := NewGitMirror(mirror, url.URL{Scheme: "file", Path: filepath.Join(dir, "remote")})
+	m.Git = "false"
+	for _, project := range []string{
+		"../x",
+		"../../x",
+		"a/../../x",
+		"a/..",
+		"/tmp/x",
+		"",
+	} {
+		if _, _, err := m.fetch(context.Background(), project+"~1", "1"); err == nil || !strings.Contains(err.Error(), "project") {
+			t.Errorf("fetch(%q): got %v, want project name error", project, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a")); !os.IsNotExist(err) {
+		t.Errorf("fetch created directories: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "x.git")); !os.IsNotExist(err) {
+		t.Errorf("fetch created a repository outside the mirror: %v", err)
+	}
+
+	// Names with a ".." inside an element are fine.
+	if err := checkProjectName("a/b..c"); err != nil {
+		t.Errorf("checkProjectName(a/b..c): %v", err)
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gerrit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// helperCredential is the output of a credential helper.
+type helperCredential struct {
+	username string
+	password string
+	token    string
+	expires  time.Time
+
+	// request is the input that the helper answered.
+	request string
+
+	// approved is set once the credential has been approved.
+	approved bool
+}
+
+// helperTimeout bounds the approve and reject commands, which run
+// outside of a request.
+const helperTimeout = 30 * time.Second
+
+// parseHelperOutput parses the key=value lines written by a
+// credential helper.
+func parseHelperOutput(out []byte) (*helperCredential, error) {
+	c := &helperCredential{}
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		idx := strings.Index(line, "=")
+		if idx < 0 {
+			return nil, fmt.Errorf("malformed line %q", line)
+		}
+		key, value := line[:idx], line[idx+1:]
+		switch key {
+		case "username":
+			c.username = value
+		case "password":
+			c.password = value
+		case "token":
+			c.token = value
+		case "expiry", "password_expiry_utc":
+			secs, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+			c.expires = time.Unix(secs, 0)
+		}
+	}
+	if c.token == "" && c.password == "" {
+		return nil, fmt.Errorf("no password or token")
+	}
+	return c, nil
+}
+
+// CommandAuth gets credentials by running a helper command, which
+// speaks the protocol of git credential helpers:
+//
+// The command gets the request on standard input, as "key=value"
+// lines for protocol, host and path, followed by an empty line. It
+// answers on standard output with "key=value" lines:
+//
+//	username=USER
+//	password=SECRET
+//	token=BEARER-TOKEN
+//	expiry=UNIX-SECONDS
+//
+// A token is sent as a bearer token; otherwise username and password
+// are sent with basic authentication. expiry (or git's
+// password_expiry_utc) is optional. Other keys are ignored.
+//
+// Credentials are cached for TTL, or until expiry if that is earlier,
+// and the helper runs again after the server answers 401 or 403.
+//
+// If set, ApproveCommand runs once the server accepts a credential, and
+// RejectCommand runs when it refuses one with a 401. They get the request
+// followed by the credential on standard input, like "git credential
+// approve" and "git credential reject".
+type CommandAuth struct {
+	Command []string
+	TTL     time.Duration
+
+	ApproveCommand []string
+	RejectCommand  []string
+
+	mu      sync.Mutex
+	cred    *helperCredential
+	expires time.Time
+}
+
+// NewCommandAuth creates a CommandAuth that runs the given command.
+func NewCommandAuth(command []string, ttl time.Duration) *CommandAuth {
+	return &CommandAuth{
+		Command: command,
+		TTL:     ttl,
+	}
+}
+
+// NewGitCredentialAuth creates a CommandAuth that uses the credential
+// helpers configured for git, through "git credential fill". Accepted
+// and refused credentials are reported with "git credential approve"
+// and "git credential reject", so helpers can store or forget them.
+func NewGitCredentialAuth(ttl time.Duration) *CommandAuth {
+	a := NewCommandAuth([]string{"git", "credential", "fill"}, ttl)
+	a.ApproveCommand = []string{"git", "credential", "approve"}
+	a.RejectCommand = []string{"git", "credential", "reject"}
+	return a
+}
+
+// runHelper runs a helper command with the given input, and returns
+// its standard output.
+func runHelper(ctx context.Context, command []string, input string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = strings.NewReader(input)
+	// Never prompt; we run unattended.
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("credential helper %v: %v, stderr: %s", command, err, stderr.String())
+	}
+	return out, nil
+}
+
+// run runs the helper for a request.
+func (a *CommandAuth) run(req *http.Request) (*helperCredential, error) {
+	if len(a.Command) == 0 {
+		return nil, fmt.Errorf("no credential helper command")
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	request := fmt.Sprintf("protocol=%s\nhost=%s\npath=%s\n", req.URL.Scheme, req.URL.Host, path)
+	out, err := runHelper(req.Context(), a.Command, request+"\n")
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := parseHelperOutput(out)
+	if err != nil {
+		return nil, fmt.Errorf("credential helper %v: %v", a.Command, err)
+	}
+	c.request = request
+	return c, nil
+}
+
+// report runs an approve or reject command for a credential.
+func (a *CommandAuth) report(command []string, c *helperCredential) error {
+	if len(command) == 0 {
+		return nil
+	}
+
+	var input strings.Builder
+	input.WriteString(c.request)
+	if c.username != "" {
+		fmt.Fprintf(&input, "username=%s\n", c.username)
+	}
+	if c.password != "" {
+		fmt.Fprintf(&input, "password=%s\n", c.password)
+	}
+	if c.token != "" {
+		fmt.Fprintf(&input, "token=%s\n", c.token)
+	}
+	if !c.expires.IsZero() {
+		fmt.Fprintf(&input, "password_expiry_utc=%d\n", c.expires.Unix())
+	}
+	input.WriteString("\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), helperTimeout)
+	defer cancel()
+	_, err := runHelper(ctx, command, input.String())
+	return err
+}
+
+func (a *CommandAuth) Authenticate(req *http.Request) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	if a.cred == nil || !now.Before(a.expires) {
+		c, err := a.run(req)
+		if err != nil {
+			return err
+		}
+		a.cred = c
+		a.expires = now.Add(a.TTL)
+		if !c.expires.IsZero() && c.expires.Before(a.expires) {
+			a.expires = c.expires
+		}
+	}
+
+	if a.cred.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.cred.token)
+	} else {
+		req.SetBasicAuth(a.cred.username, a.cred.password)
+	}
+	return nil
+}
+
+// Approve reports the cached credentials as accepted, once.
+func (a *CommandAuth) Approve() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cred == nil || a.cred.approved {
+		return
+	}
+	a.cred.approved = true
+	if err := a.report(a.ApproveCommand, a.cred); err != nil {
+		log.Printf("approve: %v", err)
+	}
+}
+
+// Reject reports the cached credentials as refused, and drops them.
+func (a *CommandAuth) Reject() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cred == nil {
+		return
+	}
+	if err := a.report(a.RejectCommand, a.cred); err != nil {
+		log.Printf("reject: %v", err)
+	}
+	a.cred = nil
+}
+
+// Invalidate drops the cached credentials, so the helper runs again
+// for the next request.
+func (a *CommandAuth) Invalidate() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cred = nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gerrit
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHelperOutput(t *testing.T) {
+	c, err := parseHelperOutput([]byte("username=u\npassword=p=q\r\nexpiry=1563178021\nother=x\n"))
+	if err != nil {
+		t.Fatalf("parseHelperOutput: %v", err)
+	}
+	if c.username != "u" || c.password != "p=q" || c.expires.Unix() != 1563178021 {
+		t.Errorf("parseHelperOutput: got %+v", c)
+	}
+
+	for _, out := range []string{"username=u\n", "password\n", "password=p\nexpiry=soon\n"} {
+		if _, err := parseHelperOutput([]byte(out)); err == nil {
+			t.Errorf("parseHelperOutput(%q): got nil error", out)
+		}
+	}
+}
+
+func TestCommandAuthApproveReject(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	dir, err := ioutil.TempDir("", "helper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The helper hands out passwords p1, p2, ... and the approve and
+	// reject commands log their input.
+	counter := filepath.Join(dir, "counter")
+	approved := filepath.Join(dir, "approved")
+	rejected := filepath.Join(dir, "rejected")
+	fill := `cat > /dev/null; echo x >> ` + counter + `; echo username=u; echo password=p$(wc -l < ` + counter + ` | tr -d ' ')`
+	a := NewCommandAuth([]string{"sh", "-c", fill}, time.Hour)
+	a.ApproveCommand = []string{"sh", "-c", "cat >> " + approved}
+	a.RejectCommand = []string{"sh", "-c", "cat >> " + rejected}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pw, _ := r.BasicAuth(); pw != "p2" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := New(*u)
+	g.Authenticator = a
+
+	for i := 0; i < 2; i++ {
+		if _, err := g.GetPath("a/accounts/self"); err != nil {
+			t.Fatalf("GetPath: %v", err)
+		}
+	}
+
+	read := func(name string) string {
+		content, err := ioutil.ReadFile(name)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+	request := "protocol=http\nhost=" + u.Host + "\npath=a/accounts/self\n"
+	if got, want := read(rejected), request+"username=u\npassword=p1\n\n"; got != want {
+		t.Errorf("rejected: got %q, want %q", got, want)
+	}
+	// The accepted credential is approved once.
+	if got, want := read(approved), request+"username=u\npassword=p2\n\n"; got != want {
+		t.Errorf("approved: got %q, want %q", got, want)
+	}
+	if got := strings.Count(read(counter), "x"); got != 2 {
+		t.Errorf("helper ran %d times, want 2", got)
+	}
+}
+
+func TestCommandAuthForbidden(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	dir, err := ioutil.TempDir("", "helper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	counter := filepath.Join(dir, "counter")
+	rejected := filepath.Join(dir, "rejected")
+	fill := `cat > /dev/null; echo x >> ` + counter + `; echo username=u; echo password=p`
+	a := NewCommandAuth([]string{"sh", "-c", fill}, time.Hour)
+	a.RejectCommand = []string{"sh", "-c", "cat >> " + rejected}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := New(*u)
+	g.Authenticator = a
+	g.Retry.MaxAttempts = 1
+
+	if _, err := g.GetPath("a/accounts/self"); StatusCode(err) != http.StatusForbidden {
+		t.Fatalf("GetPath: got %v, want status 403", err)
+	}
+	// A 403 refreshes the credentials, but doesn't reject them.
+	if _, err := os.Stat(rejected); !os.IsNotExist(err) {
+		t.Errorf("credentials rejected after 403: %v", err)
+	}
+	content, err := ioutil.ReadFile(counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(content), "x"); got != 2 {
+		t.Errorf("helper ran %d times, want 2", got)
+	}
+}
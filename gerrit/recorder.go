@@ -0,0 +1,287 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gerrit
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// RecordMode selects what a Recorder does.
+type RecordMode int
+
+const (
+	// Record passes requests on, and saves the responses.
+	Record RecordMode = iota
+
+	// Replay serves saved responses, without network access.
+	Replay
+)
+
+// redactedParams are URL query parameters that carry credentials.
+var redactedParams = []string{"access_token", "token", "auth", "key"}
+
+// redactedFields are the fields of JSON and form request bodies that
+// carry credentials or review text.
+var redactedFields = map[string]bool{
+	"access_token":  true,
+	"token":         true,
+	"password":      true,
+	"http_password": true,
+	"message":       true,
+}
+
+// interaction is a request and its response, as stored in a fixture
+// file.
+type interaction struct {
+	Method      string `json:"method"`
+	URL         string `json:"url"`
+	RequestBody []byte `json:"request_body,omitempty"`
+
+	// RequestBodyHash identifies the redacted request body.
+	RequestBodyHash string `json:"request_body_sha1,omitempty"`
+
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+}
+
+// Recorder is an http.RoundTripper for Server.Client that records
+// interactions into a directory of fixtures, or replays them.
+//
+// Requests are matched on method, path and query, but not on host.
+// Requests with a body, such as POSTs, are matched on a hash of the
+// redacted body too. Repeated requests are stored in sequence, so the
+// n-th replayed request for a URL and body gets the n-th recorded
+// response. Authorization and Cookie headers are never stored,
+// Set-Cookie is dropped from responses, and credential query
+// parameters are redacted. In JSON and form request bodies, the
+// fields in redactedFields, which hold credentials and review text,
+// are redacted. Other request bodies are not stored.
+//
+// In replay mode, an unmatched request fails with an error.
+type Recorder struct {
+	Dir  string
+	Mode RecordMode
+
+	// Transport makes the actual requests in record mode. If nil,
+	// http.DefaultTransport is used.
+	Transport http.RoundTripper
+
+	mu    sync.Mutex
+	count map[string]int
+}
+
+// NewRecorder returns a Recorder for the fixtures in dir.
+func NewRecorder(dir string, mode RecordMode) (*Recorder, error) {
+	if mode == Record {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	} else if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	return &Recorder{
+		Dir:   dir,
+		Mode:  mode,
+		count: map[string]int{},
+	}, nil
+}
+
+// redactedURL returns the path and query of the request, with
+// credentials replaced.
+func redactedURL(req *http.Request) string {
+	u := *req.URL
+	q := u.Query()
+	for _, p := range redactedParams {
+		if _, ok := q[p]; ok {
+			q.Set(p, "REDACTED")
+		}
+	}
+	u.RawQuery = q.Encode()
+	u.Scheme = ""
+	u.Host = ""
+	u.User = nil
+	return u.String()
+}
+
+// redactValue replaces the redacted fields in a decoded JSON value.
+func redactValue(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if _, ok := e.(string); ok && redactedFields[k] {
+				v[k] = "REDACTED"
+			} else {
+				redactValue(e)
+			}
+		}
+	case []interface{}:
+		for _, e := range v {
+			redactValue(e)
+		}
+	}
+}
+
+// redactedBody returns the request body to store, and the hash by which
+// it is matched. The hash covers the redacted body, if it could be
+// redacted, and the full body otherwise.
+func redactedBody(req *http.Request, body []byte) (stored []byte, hash string) {
+	if len(body) == 0 {
+		return nil, ""
+	}
+
+	ct, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch ct {
+	case "application/json":
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err == nil {
+			redactValue(v)
+			// Marshal sorts map keys, so equal values hash equally.
+			stored, _ = json.Marshal(v)
+		}
+	case "application/x-www-form-urlencoded":
+		if q, err := url.ParseQuery(string(body)); err == nil {
+			for k := range q {
+				if redactedFields[k] {
+					q.Set(k, "REDACTED")
+				}
+			}
+			stored = []byte(q.Encode())
+		}
+	}
+
+	if stored == nil {
+		return nil, fmt.Sprintf("%x", sha1.Sum(body))
+	}
+	return stored, fmt.Sprintf("%x", sha1.Sum(stored))
+}
+
+// next returns the fixture file for the next occurrence of the
+// request.
+func (r *Recorder) next(method, u string, bodyHash string) string {
+	key := method + " " + u
+	if bodyHash != "" {
+		key += " " + bodyHash
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := r.count[key]
+	r.count[key] = n + 1
+	return filepath.Join(r.Dir, fmt.Sprintf("%x-%03d.json", sha1.Sum([]byte(key)), n))
+}
+
+// RoundTrip implements http.RoundTripper.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		reqBody, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		clone := *req
+		clone.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+		req = &clone
+	}
+
+	u := redactedURL(req)
+	storedBody, bodyHash := redactedBody(req, reqBody)
+	name := r.next(req.Method, u, bodyHash)
+
+	if r.Mode == Replay {
+		return r.replay(req, name, u, bodyHash)
+	}
+
+	transport := r.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	rep, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(rep.Body)
+	rep.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	rep.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	header := rep.Header.Clone()
+	header.Del("Set-Cookie")
+	content, err := json.MarshalIndent(&interaction{
+		Method:          req.Method,
+		URL:             u,
+		RequestBody:     storedBody,
+		RequestBodyHash: bodyHash,
+		StatusCode:      rep.StatusCode,
+		Header:          header,
+		Body:            body,
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(name, content, 0644); err != nil {
+		return nil, err
+	}
+	return rep, nil
+}
+
+func (r *Recorder) replay(req *http.Request, name, u string, bodyHash string) (*http.Response, error) {
+	content, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) && bodyHash != "" {
+		return nil, fmt.Errorf("replay: no recorded response for %s %s with body %s", req.Method, u, bodyHash)
+	} else if os.IsNotExist(err) {
+		return nil, fmt.Errorf("replay: no recorded response for %s %s", req.Method, u)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var i interaction
+	if err := json.Unmarshal(content, &i); err != nil {
+		return nil, fmt.Errorf("replay %s: %v", name, err)
+	}
+	if i.Method != req.Method || i.URL != u {
+		return nil, fmt.Errorf("replay %s: recorded %s %s, got %s %s", name, i.Method, i.URL, req.Method, u)
+	}
+	if i.RequestBodyHash != bodyHash {
+		return nil, fmt.Errorf("replay %s: recorded body %s, got %s", name, i.RequestBodyHash, bodyHash)
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", i.StatusCode, http.StatusText(i.StatusCode)),
+		StatusCode:    i.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        i.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(i.Body)),
+		ContentLength: int64(len(i.Body)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gerrit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func post(t *testing.T, rt http.RoundTripper, url, contentType, body string) (string, error) {
+	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	rep, err := rt.RoundTrip(req)
+	if err != nil {
+		return "", err
+	}
+	defer rep.Body.Close()
+	out, err := ioutil.ReadAll(rep.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out), nil
+}
+
+func TestRecorderBodies(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte("echo " + string(body)))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rec, err := NewRecorder(dir, Record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodies := []string{
+		`{"checker_uuid":"a","message":"secret review text"}`,
+		`{"checker_uuid":"b","message":"more text"}`,
+	}
+	for _, b := range bodies {
+		if _, err := post(t, rec, ts.URL+"/checks/", "application/json", b); err != nil {
+			t.Fatalf("record: %v", err)
+		}
+	}
+	if _, err := post(t, rec, ts.URL+"/login", "application/x-www-form-urlencoded", "username=u&password=hunter2"); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Errorf("got %d fixtures, want 3", len(files))
+	}
+	for _, f := range files {
+		content, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Request bodies are stored base64 encoded, so check the
+		// decoded interaction.
+		var i interaction
+		if err := json.Unmarshal(content, &i); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(i.RequestBody, []byte("REDACTED")) {
+			t.Errorf("%s: body %q is not redacted", f, i.RequestBody)
+		}
+		for _, secret := range []string{"secret review text", "more text", "hunter2"} {
+			if bytes.Contains(i.RequestBody, []byte(secret)) {
+				t.Errorf("%s: body %q contains %q", f, i.RequestBody, secret)
+			}
+		}
+	}
+
+	replay, err := NewRecorder(dir, Replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replay in a different order; the body selects the response.
+	for i := len(bodies) - 1; i >= 0; i-- {
+		got, err := post(t, replay, "http://elsewhere/checks/", "application/json", bodies[i])
+		if err != nil {
+			t.Fatalf("replay: %v", err)
+		}
+		if want := "echo " + bodies[i]; got != want {
+			t.Errorf("replay: got %q, want %q", got, want)
+		}
+	}
+
+	// Redacted fields don't take part in matching.
+	replay, err = NewRecorder(dir, Replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := post(t, replay, "http://elsewhere/checks/", "application/json", `{"message":"other text","checker_uuid":"a"}`); err != nil {
+		t.Errorf("replay with other message: %v", err)
+	}
+	if _, err := post(t, replay, "http://elsewhere/checks/", "application/json", `{"checker_uuid":"c","message":"x"}`); err == nil {
+		t.Errorf("replay with other body: got nil error")
+	}
+}
+
+func TestRecorderBodyMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rec, err := NewRecorder(dir, Replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", "http://gerrit/x", strings.NewReader(`{"a":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	u := redactedURL(req)
+	_, hash := redactedBody(req, []byte(`{"a":1}`))
+
+	// A fixture stored under the right name, but for another body.
+	name := rec.next("POST", u, hash)
+	rec.count = map[string]int{}
+	content := `{"method":"POST","url":"/x","request_body_sha1":"0000","status_code":200,"header":{},"body":""}`
+	if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rec.RoundTrip(req); err == nil || !strings.Contains(err.Error(), "recorded body") {
+		t.Errorf("RoundTrip: got %v, want body mismatch", err)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gerrit
+
+import (
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestBackoffRetryAfter(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	for _, tc := range []struct {
+		retryAfter string
+		want       time.Duration
+		wantOK     bool
+	}{
+		{"5", 5 * time.Second, true},
+		{"10", 10 * time.Second, true},
+		{"11", 0, false},
+		{"3600", 0, false},
+	} {
+		rep := &http.Response{Header: http.Header{"Retry-After": {tc.retryAfter}}}
+		got, ok := p.backoff(0, rep)
+		if got != tc.want || ok != tc.wantOK {
+			t.Errorf("backoff with Retry-After %s: got %v, %v, want %v, %v", tc.retryAfter, got, ok, tc.want, tc.wantOK)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		d, ok := p.backoff(i, nil)
+		if !ok || d > p.MaxBackoff {
+			t.Errorf("backoff(%d): got %v, %v, want at most %v", i, d, ok, p.MaxBackoff)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetryableError(t *testing.T) {
+	wrap := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://gerrit/", Err: err}
+	}
+	opErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", errno)}
+	}
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{wrap(io.EOF), true},
+		{wrap(io.ErrUnexpectedEOF), true},
+		{wrap(opErr(syscall.ECONNRESET)), true},
+		{wrap(opErr(syscall.ECONNREFUSED)), true},
+		{wrap(timeoutError{}), true},
+		{wrap(&net.DNSError{Err: "no such host", Name: "gerrit", IsNotFound: true}), false},
+		{wrap(&net.DNSError{Err: "server misbehaving", Name: "gerrit", IsTemporary: true}), true},
+		{wrap(x509.UnknownAuthorityError{}), false},
+		{wrap(x509.HostnameError{Host: "gerrit"}), false},
+		{wrap(errors.New(`unsupported protocol scheme "htp"`)), false},
+	} {
+		if got := retryableError(tc.err); got != tc.want {
+			t.Errorf("retryableError(%v): got %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestNewRateLimiter(t *testing.T) {
+	for _, qps := range []float64{0, -1} {
+		if _, err := NewRateLimiter(qps, 1); err == nil {
+			t.Errorf("NewRateLimiter(%v): got nil error", qps)
+		}
+	}
+	if _, err := NewRateLimiter(0.5, 0); err != nil {
+		t.Errorf("NewRateLimiter(0.5): %v", err)
+	}
+}
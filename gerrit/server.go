@@ -16,14 +16,19 @@ package gerrit
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 // Server represents a single Gerrit host.
@@ -36,6 +41,15 @@ type Server struct {
 	Debug bool
 
 	Authenticator Authenticator
+
+	// Retry configures retries of failed idempotent requests.
+	Retry RetryPolicy
+
+	// RateLimiter, if set, limits the rate of outgoing requests.
+	RateLimiter *RateLimiter
+
+	// Fetch configures how GetChange retrieves file contents.
+	Fetch FetchOptions
 }
 
 type Authenticator interface {
@@ -43,32 +57,93 @@ type Authenticator interface {
 	Authenticate(req *http.Request) error
 }
 
+// Invalidator is implemented by Authenticators that cache
+// credentials. When the server answers 401 or 403, Do calls
+// Invalidate, and retries the request once, so Authenticate can
+// reload or refresh the credentials.
+type Invalidator interface {
+	Invalidate()
+}
+
+// Approver is implemented by Authenticators that want to know when the
+// server accepted their credentials.
+type Approver interface {
+	Approve()
+}
+
+// Rejecter is implemented by Authenticators that want to know when the
+// server refused their credentials. Do calls Reject on 401 only: a 403
+// means the credentials were valid but lack permission.
+type Rejecter interface {
+	Reject()
+}
+
 // BasicAuth adds the "Basic Authorization" header to an outgoing request.
 type BasicAuth struct {
 	// Base64 encoded user:secret string.
 	EncodedBasicAuth string
+
+	// file, if set, holds the user:secret string instead.
+	file *reloadingFile
+}
+
+// encodeBasicAuth encodes a "user:secret" string.
+func encodeBasicAuth(who string) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.TrimSpace(who)))
 }
 
 // NewBasicAuth creates a BasicAuth authenticator. |who| should be a
 // "user:secret" string.
 func NewBasicAuth(who string) *BasicAuth {
-	auth := strings.TrimSpace(who)
-	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(auth)))
-	base64.StdEncoding.Encode(encoded, []byte(auth))
 	return &BasicAuth{
-		EncodedBasicAuth: string(encoded),
+		EncodedBasicAuth: encodeBasicAuth(who),
 	}
 }
 
+// NewBasicAuthFile creates a BasicAuth authenticator that reads the
+// "user:secret" string from a file. The file is read again when it
+// changes, or when the server rejects the password.
+func NewBasicAuthFile(path string) (*BasicAuth, error) {
+	b := &BasicAuth{
+		file: &reloadingFile{
+			path: path,
+			parse: func(content []byte) (interface{}, error) {
+				return encodeBasicAuth(string(content)), nil
+			},
+		},
+	}
+	if _, err := b.file.get(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
 func (b *BasicAuth) Authenticate(req *http.Request) error {
-	req.Header.Set("Authorization", "Basic "+string(b.EncodedBasicAuth))
+	encoded := b.EncodedBasicAuth
+	if b.file != nil {
+		v, err := b.file.get()
+		if err != nil {
+			return err
+		}
+		encoded = v.(string)
+	}
+	req.Header.Set("Authorization", "Basic "+encoded)
 	return nil
 }
 
+// Invalidate makes the next request read the file again, if the
+// password came from a file.
+func (b *BasicAuth) Invalidate() {
+	if b.file != nil {
+		b.file.invalidate()
+	}
+}
+
 // New creates a Gerrit Server for the given URL.
 func New(u url.URL) *Server {
 	g := &Server{
-		URL: u,
+		URL:   u,
+		Retry: DefaultRetryPolicy,
 	}
 
 	g.Client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
@@ -78,26 +153,38 @@ func New(u url.URL) *Server {
 	return g
 }
 
-// GetPath runs a Get on the given path.
-func (g *Server) GetPath(p string) ([]byte, error) {
+// pathURL returns the URL for an escaped path on the server.
+func (g *Server) pathURL(p string) *url.URL {
 	u := g.URL
-	u.Path = path.Join(u.Path, p)
-	if strings.HasSuffix(p, "/") && !strings.HasSuffix(u.Path, "/") {
+	raw := path.Join(u.EscapedPath(), p)
+	if strings.HasSuffix(p, "/") && !strings.HasSuffix(raw, "/") {
 		// Ugh.
-		u.Path += "/"
+		raw += "/"
 	}
-	return g.Get(&u)
+	if unescaped, err := url.PathUnescape(raw); err == nil {
+		u.Path = unescaped
+		u.RawPath = raw
+	} else {
+		u.Path = raw
+	}
+	return &u
 }
 
-// Do runs a HTTP request against the remote server.
+// GetPath runs a Get on the given path.
+func (g *Server) GetPath(p string) ([]byte, error) {
+	return g.GetPathContext(context.Background(), p)
+}
+
+// GetPathContext runs a Get on the given path.
+func (g *Server) GetPathContext(ctx context.Context, p string) ([]byte, error) {
+	return g.GetContext(ctx, g.pathURL(p))
+}
+
+// Do runs a HTTP request against the remote server. Idempotent
+// requests that fail with a transient error are retried according to
+// the server's RetryPolicy.
 func (g *Server) Do(req *http.Request) (*http.Response, error) {
 	req.Header.Set("User-Agent", g.UserAgent)
-	if g.Authenticator != nil {
-		if err := g.Authenticator.Authenticate(req); err != nil {
-			return nil, err
-		}
-	}
-
 	if g.Debug {
 		if req.URL.RawQuery != "" {
 			req.URL.RawQuery += "&trace=0x1"
@@ -105,60 +192,159 @@ func (g *Server) Do(req *http.Request) (*http.Response, error) {
 			req.URL.RawQuery += "trace=0x1"
 		}
 	}
-	return g.Client.Do(req)
+
+	attempts := 1
+	if isIdempotent(req) && (req.Body == nil || req.GetBody != nil) {
+		attempts = g.Retry.MaxAttempts
+	}
+
+	ctx := req.Context()
+	reauthenticated := false
+	for i := 0; ; i++ {
+		if (i > 0 || reauthenticated) && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+		if g.RateLimiter != nil {
+			if err := g.RateLimiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+		if g.Authenticator != nil {
+			if err := g.Authenticator.Authenticate(req); err != nil {
+				return nil, err
+			}
+		}
+
+		rep, err := g.Client.Do(req)
+		if err == nil && rep.StatusCode == http.StatusUnauthorized {
+			if rj, ok := g.Authenticator.(Rejecter); ok {
+				rj.Reject()
+			}
+		}
+		if err == nil && (rep.StatusCode == http.StatusUnauthorized || rep.StatusCode == http.StatusForbidden) {
+			inv, ok := g.Authenticator.(Invalidator)
+			if ok && !reauthenticated && (req.Body == nil || req.GetBody != nil) {
+				// The request was rejected before doing anything, so
+				// it can be retried even if it isn't idempotent. This
+				// doesn't count as an attempt.
+				log.Printf("%s %s: status %d, reauthenticating", req.Method, req.URL, rep.StatusCode)
+				io.Copy(ioutil.Discard, rep.Body)
+				rep.Body.Close()
+				inv.Invalidate()
+				reauthenticated = true
+				i--
+				continue
+			}
+		}
+		if err == nil && rep.StatusCode/100 == 2 {
+			if ap, ok := g.Authenticator.(Approver); ok {
+				ap.Approve()
+			}
+		}
+		if i+1 >= attempts || ctx.Err() != nil {
+			return rep, err
+		}
+		if err == nil && !retryableStatus(rep.StatusCode) {
+			return rep, nil
+		}
+		if err != nil && !retryableError(err) {
+			return nil, err
+		}
+
+		delay, ok := g.Retry.backoff(i, rep)
+		if !ok {
+			log.Printf("%s %s: status %d, Retry-After %q exceeds %v; giving up", req.Method, req.URL, rep.StatusCode, rep.Header.Get("Retry-After"), g.Retry.MaxBackoff)
+			return rep, nil
+		}
+		if err == nil {
+			log.Printf("%s %s: status %d, retrying in %v", req.Method, req.URL, rep.StatusCode, delay)
+			io.Copy(ioutil.Discard, rep.Body)
+			rep.Body.Close()
+		} else {
+			log.Printf("%s %s: %v, retrying in %v", req.Method, req.URL, err, delay)
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
 }
 
-// Get runs a HTTP GET request on the given URL.
-func (g *Server) Get(u *url.URL) ([]byte, error) {
-	req, err := http.NewRequest("GET", u.String(), nil)
+// doRequest runs a request, and returns the response body. Non-2xx
+// responses yield an *Error.
+func (g *Server) doRequest(ctx context.Context, method string, u *url.URL, contentType string, content []byte) ([]byte, error) {
+	var body io.Reader
+	if content != nil {
+		body = bytes.NewReader(content)
+	}
+	req, err := http.NewRequest(method, u.String(), body)
 	if err != nil {
 		return nil, err
 	}
+	req = req.WithContext(ctx)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
 	rep, err := g.Do(req)
 	if err != nil {
 		return nil, err
 	}
+	defer rep.Body.Close()
+
+	all, err := ioutil.ReadAll(rep.Body)
 	if rep.StatusCode/100 != 2 {
-		return nil, fmt.Errorf("Get %s: status %d", u.String(), rep.StatusCode)
+		return nil, newError(method, u.String(), rep, all)
+	}
+	if err != nil {
+		return nil, err
 	}
+	return all, nil
+}
 
-	defer rep.Body.Close()
-	return ioutil.ReadAll(rep.Body)
+// Get runs a HTTP GET request on the given URL.
+func (g *Server) Get(u *url.URL) ([]byte, error) {
+	return g.GetContext(context.Background(), u)
+}
+
+// GetContext runs a HTTP GET request on the given URL.
+func (g *Server) GetContext(ctx context.Context, u *url.URL) ([]byte, error) {
+	return g.doRequest(ctx, "GET", u, "", nil)
 }
 
 // PostPath posts the given data onto a path.
 func (g *Server) PostPath(p string, contentType string, content []byte) ([]byte, error) {
-	u := g.URL
-	u.Path = path.Join(u.Path, p)
-	if strings.HasSuffix(p, "/") && !strings.HasSuffix(u.Path, "/") {
-		// Ugh.
-		u.Path += "/"
-	}
-	req, err := http.NewRequest("POST", u.String(), bytes.NewBuffer(content))
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("Content-Type", contentType)
-	rep, err := g.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	if rep.StatusCode/100 != 2 {
-		return nil, fmt.Errorf("Post %s: status %d", u.String(), rep.StatusCode)
-	}
+	return g.PostPathContext(context.Background(), p, contentType, content)
+}
 
-	defer rep.Body.Close()
-	return ioutil.ReadAll(rep.Body)
+// PostPathContext posts the given data onto a path.
+func (g *Server) PostPathContext(ctx context.Context, p string, contentType string, content []byte) ([]byte, error) {
+	return g.doRequest(ctx, "POST", g.pathURL(p), contentType, content)
 }
 
 // GetContent returns the file content from a file in a change.
 func (g *Server) GetContent(changeID string, revID string, fileID string) ([]byte, error) {
-	u := g.URL
-	path := path.Join(u.Path, fmt.Sprintf("changes/%s/revisions/%s/files/",
-		url.PathEscape(changeID), revID))
-	u.Path = path + "/" + fileID + "/content"
-	u.RawPath = path + "/" + url.PathEscape(fileID) + "/content"
-	c, err := g.Get(&u)
+	return g.GetContentContext(context.Background(), changeID, revID, fileID)
+}
+
+// GetContentContext returns the file content from a file in a change.
+func (g *Server) GetContentContext(ctx context.Context, changeID string, revID string, fileID string) ([]byte, error) {
+	return g.GetBaseContentContext(ctx, changeID, revID, fileID, 0)
+}
+
+// GetBaseContentContext returns the content of a file in the given
+// 1-based parent of a revision. Parent 0 returns the content in the
+// revision itself.
+func (g *Server) GetBaseContentContext(ctx context.Context, changeID string, revID string, fileID string, parent int) ([]byte, error) {
+	u := g.pathURL(fmt.Sprintf("changes/%s/revisions/%s/files/%s/content",
+		url.PathEscape(changeID), revID, url.PathEscape(fileID)))
+	if parent > 0 {
+		u.RawQuery = "parent=" + strconv.Itoa(parent)
+	}
+	c, err := g.GetContext(ctx, u)
 	if err != nil {
 		return nil, err
 	}
@@ -173,8 +359,25 @@ func (g *Server) GetContent(changeID string, revID string, fileID string) ([]byt
 
 // GetChange returns the Change (including file contents) for a given change.
 func (g *Server) GetChange(changeID string, revID string) (*Change, error) {
-	content, err := g.GetPath(fmt.Sprintf("changes/%s/revisions/%s/files/",
+	return g.GetChangeContext(context.Background(), changeID, revID)
+}
+
+// GetChangeContext returns the Change (including file contents) for a given change.
+func (g *Server) GetChangeContext(ctx context.Context, changeID string, revID string) (*Change, error) {
+	return g.GetChangeParentContext(ctx, changeID, revID, 0)
+}
+
+// GetChangeParentContext returns the Change (including file contents)
+// for a given change, with the files compared against the given
+// 1-based parent. Parent 0 selects Gerrit's default base, which is
+// the parent for ordinary commits, and the auto-merge for merges.
+func (g *Server) GetChangeParentContext(ctx context.Context, changeID string, revID string, parent int) (*Change, error) {
+	u := g.pathURL(fmt.Sprintf("changes/%s/revisions/%s/files/",
 		url.PathEscape(changeID), revID))
+	if parent > 0 {
+		u.RawQuery = "parent=" + strconv.Itoa(parent)
+	}
+	content, err := g.GetContext(ctx, u)
 	if err != nil {
 		return nil, err
 	}
@@ -185,21 +388,121 @@ func (g *Server) GetChange(changeID string, revID string) (*Change, error) {
 		return nil, err
 	}
 
-	for name, file := range files {
-		if file.Status == "D" {
-			continue
+	if err := g.fetchContents(ctx, changeID, revID, files); err != nil {
+		return nil, err
+	}
+
+	return &Change{
+		Files:  files,
+		Parent: parent,
+		base:   g.baseFetcher(changeID, revID, parent, files),
+	}, nil
+}
+
+// baseFetcher returns the baseFetcher for a Change. For parent 0, the
+// base of a merge is the auto-merge, like for the list of files.
+func (g *Server) baseFetcher(changeID string, revID string, parent int, files map[string]*File) baseFetcher {
+	if parent > 0 {
+		return func(ctx context.Context, name string) ([]byte, error) {
+			return g.GetBaseContentContext(ctx, changeID, revID, name, parent)
+		}
+	}
+
+	// The diff is requested by new path, so map old paths back.
+	newPaths := map[string]string{}
+	for n, f := range files {
+		if f.OldPath != "" {
+			newPaths[f.OldPath] = n
 		}
-		c, err := g.GetContent(changeID, revID, name)
-		if err != nil {
-			return nil, err
+	}
+
+	var mu sync.Mutex
+	parents := -1
+	return func(ctx context.Context, name string) ([]byte, error) {
+		mu.Lock()
+		n := parents
+		mu.Unlock()
+		if n < 0 {
+			var err error
+			if n, err = g.countParents(ctx, changeID, revID); err != nil {
+				return nil, err
+			}
+			mu.Lock()
+			parents = n
+			mu.Unlock()
+		}
+		if n < 2 {
+			return g.GetBaseContentContext(ctx, changeID, revID, name, 1)
 		}
+		if newPath, ok := newPaths[name]; ok {
+			name = newPath
+		}
+		return g.getAutoMergeContent(ctx, changeID, revID, name)
+	}
+}
+
+// countParents returns the number of parents of a revision.
+func (g *Server) countParents(ctx context.Context, changeID string, revID string) (int, error) {
+	u := g.pathURL(fmt.Sprintf("changes/%s/revisions/%s/commit",
+		url.PathEscape(changeID), revID))
+	content, err := g.GetContext(ctx, u)
+	if err != nil {
+		return 0, err
+	}
+	var commit struct {
+		Parents []json.RawMessage `json:"parents"`
+	}
+	if err := Unmarshal(content, &commit); err != nil {
+		return 0, err
+	}
+	return len(commit.Parents), nil
+}
 
-		files[name].Content = c
+// getAutoMergeContent returns the content of a file in the auto-merge
+// of a merge commit. Gerrit doesn't serve the auto-merge directly, so
+// it is put together from the diff against it. The diff doesn't say
+// whether the file ends in a newline, so the result always does.
+func (g *Server) getAutoMergeContent(ctx context.Context, changeID string, revID string, fileID string) ([]byte, error) {
+	u := g.pathURL(fmt.Sprintf("changes/%s/revisions/%s/files/%s/diff",
+		url.PathEscape(changeID), revID, url.PathEscape(fileID)))
+	u.RawQuery = "context=ALL&intraline=false&whitespace=IGNORE_NONE"
+	content, err := g.GetContext(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	var diff struct {
+		Binary  bool `json:"binary"`
+		Content []struct {
+			A  []string `json:"a"`
+			AB []string `json:"ab"`
+		} `json:"content"`
 	}
-	return &Change{files}, nil
+	if err := Unmarshal(content, &diff); err != nil {
+		return nil, err
+	}
+	if diff.Binary {
+		return nil, fmt.Errorf("%s: no auto-merge content for binary files", fileID)
+	}
+
+	var buf bytes.Buffer
+	for _, c := range diff.Content {
+		// An entry has either common lines, or lines that
+		// differ.
+		for _, l := range append(c.AB, c.A...) {
+			buf.WriteString(l)
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes(), nil
 }
 
 func (s *Server) PendingChecksByScheme(scheme string) ([]*PendingChecksInfo, error) {
+	return s.PendingChecksBySchemeContext(context.Background(), scheme)
+}
+
+// PendingChecksBySchemeContext returns the checks pending for all
+// checkers of the given scheme.
+func (s *Server) PendingChecksBySchemeContext(ctx context.Context, scheme string) ([]*PendingChecksInfo, error) {
 	u := s.URL
 
 	// The trailing '/' handling is really annoying.
@@ -207,7 +510,7 @@ func (s *Server) PendingChecksByScheme(scheme string) ([]*PendingChecksInfo, err
 
 	q := "scheme:" + scheme
 	u.RawQuery = "query=" + q
-	content, err := s.Get(&u)
+	content, err := s.GetContext(ctx, &u)
 	if err != nil {
 		return nil, err
 	}
@@ -222,6 +525,11 @@ func (s *Server) PendingChecksByScheme(scheme string) ([]*PendingChecksInfo, err
 
 // PendingChecks returns the checks pending for the given checker.
 func (s *Server) PendingChecks(checkerUUID string) ([]*PendingChecksInfo, error) {
+	return s.PendingChecksContext(context.Background(), checkerUUID)
+}
+
+// PendingChecksContext returns the checks pending for the given checker.
+func (s *Server) PendingChecksContext(ctx context.Context, checkerUUID string) ([]*PendingChecksInfo, error) {
 	u := s.URL
 
 	// The trailing '/' handling is really annoying.
@@ -230,7 +538,7 @@ func (s *Server) PendingChecks(checkerUUID string) ([]*PendingChecksInfo, error)
 	q := "checker:" + checkerUUID
 	u.RawQuery = "query=" + url.QueryEscape(q)
 
-	content, err := s.Get(&u)
+	content, err := s.GetContext(ctx, &u)
 	if err != nil {
 		return nil, err
 	}
@@ -245,12 +553,20 @@ func (s *Server) PendingChecks(checkerUUID string) ([]*PendingChecksInfo, error)
 
 // PostCheck posts a single check result onto a change.
 func (s *Server) PostCheck(changeID string, psID int, input *CheckInput) (*CheckInfo, error) {
+	return s.PostCheckContext(context.Background(), changeID, psID, input)
+}
+
+// PostCheckContext posts a single check result onto a change. Checks
+// are keyed by checker UUID, so the request is retried on transient
+// failures.
+func (s *Server) PostCheckContext(ctx context.Context, changeID string, psID int, input *CheckInput) (*CheckInfo, error) {
+	ctx = WithIdempotent(ctx)
 	body, err := json.Marshal(input)
 	if err != nil {
 		return nil, err
 	}
 
-	res, err := s.PostPath(fmt.Sprintf("a/changes/%s/revisions/%d/checks/", changeID, psID),
+	res, err := s.PostPathContext(ctx, fmt.Sprintf("a/changes/%s/revisions/%d/checks/", changeID, psID),
 		"application/json", body)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,225 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gerrit_test
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gerrit-linter/gerrit"
+	"github.com/google/gerrit-linter/gerrit/fake"
+)
+
+// newRetryServer returns a fake with change 1 on repo "r" and checker
+// "fmt:a", and a client for it that retries quickly. The counter
+// tracks the requests the fake receives.
+func newRetryServer(fail func(n int, req *http.Request) int) (*fake.Server, *gerrit.Server, *requestCounter) {
+	s := fake.New()
+	s.AddChecker(&gerrit.CheckerInput{UUID: "fmt:a", Repository: "r", Status: "ENABLED"})
+	s.AddPatchSet("r", 1, 1, map[string]*gerrit.File{})
+
+	c := &requestCounter{}
+	s.Fail = func(req *http.Request) int {
+		return fail(c.add(), req)
+	}
+
+	g := gerrit.New(s.GerritURL())
+	g.Retry = gerrit.RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     10 * time.Millisecond,
+	}
+	return s, g, c
+}
+
+// requestCounter counts requests to a fake.
+type requestCounter struct {
+	mu sync.Mutex
+	n  int
+}
+
+// add counts a request, and returns its number, starting at 1.
+func (c *requestCounter) add() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n++
+	return c.n
+}
+
+func (c *requestCounter) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+// failFirst fails the first request with code.
+func failFirst(code int) func(int, *http.Request) int {
+	return func(n int, req *http.Request) int {
+		if n == 1 {
+			return code
+		}
+		return 0
+	}
+}
+
+func TestDoRetriesGet(t *testing.T) {
+	for _, tc := range []struct {
+		code     int
+		requests int
+		ok       bool
+	}{
+		{http.StatusServiceUnavailable, 2, true},
+		{http.StatusTooManyRequests, 2, true},
+		{http.StatusInternalServerError, 2, true},
+		{http.StatusNotFound, 1, false},
+		{http.StatusBadRequest, 1, false},
+	} {
+		s, g, c := newRetryServer(failFirst(tc.code))
+		_, err := g.GetPath("accounts/self")
+		if tc.ok && err != nil {
+			t.Errorf("status %d: got %v", tc.code, err)
+		} else if !tc.ok && gerrit.StatusCode(err) != tc.code {
+			t.Errorf("status %d: got %v, want status %d", tc.code, err, tc.code)
+		}
+		if got := c.count(); got != tc.requests {
+			t.Errorf("status %d: got %d requests, want %d", tc.code, got, tc.requests)
+		}
+		s.Close()
+	}
+}
+
+func TestDoGivesUp(t *testing.T) {
+	s, g, c := newRetryServer(func(int, *http.Request) int { return http.StatusServiceUnavailable })
+	defer s.Close()
+	if _, err := g.GetPath("accounts/self"); gerrit.StatusCode(err) != http.StatusServiceUnavailable {
+		t.Errorf("GetPath: got %v, want status 503", err)
+	}
+	if got := c.count(); got != 3 {
+		t.Errorf("got %d requests, want 3", got)
+	}
+}
+
+func TestDoRetryAfter(t *testing.T) {
+	s, g, c := newRetryServer(failFirst(http.StatusServiceUnavailable))
+	defer s.Close()
+	handler := s.Config.Handler
+	s.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		handler.ServeHTTP(w, req)
+	})
+
+	// The server asks to wait longer than MaxBackoff, so the request
+	// is not retried.
+	if _, err := g.GetPath("accounts/self"); gerrit.StatusCode(err) != http.StatusServiceUnavailable {
+		t.Errorf("GetPath: got %v, want status 503", err)
+	}
+	if got := c.count(); got != 1 {
+		t.Errorf("got %d requests, want 1", got)
+	}
+}
+
+func TestDoPost(t *testing.T) {
+	ctx := context.Background()
+
+	// POSTs aren't retried, unless they are marked idempotent.
+	s, g, c := newRetryServer(failFirst(http.StatusServiceUnavailable))
+	_, err := g.PostPathContext(ctx, "plugins/checks/checkers/", "application/json",
+		[]byte(`{"uuid":"fmt:b","repository":"r"}`))
+	if gerrit.StatusCode(err) != http.StatusServiceUnavailable {
+		t.Errorf("PostPath: got %v, want status 503", err)
+	}
+	if got := c.count(); got != 1 {
+		t.Errorf("PostPath: got %d requests, want 1", got)
+	}
+	s.Close()
+
+	// Checks are keyed by checker, so posting them is idempotent.
+	s, g, c = newRetryServer(failFirst(http.StatusServiceUnavailable))
+	defer s.Close()
+	in := &gerrit.CheckInput{CheckerUUID: "fmt:a", State: gerrit.StateRunning}
+	if _, err := g.PostCheckContext(ctx, "1", 1, in); err != nil {
+		t.Fatalf("PostCheck: %v", err)
+	}
+	if got := c.count(); got != 2 {
+		t.Errorf("PostCheck: got %d requests, want 2", got)
+	}
+	if got := s.Check(1, 1, "fmt:a"); got == nil || got.State != gerrit.StateRunning {
+		t.Errorf("PostCheck: got check %+v, want state RUNNING", got)
+	}
+}
+
+// staleAuth sends token "stale" until it is invalidated.
+type staleAuth struct {
+	mu          sync.Mutex
+	token       string
+	invalidated int
+}
+
+func (a *staleAuth) Authenticate(req *http.Request) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	return nil
+}
+
+func (a *staleAuth) Invalidate() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.invalidated++
+	a.token = "fresh"
+}
+
+func TestDoInvalidate(t *testing.T) {
+	ctx := context.Background()
+	s, _, c := newRetryServer(func(int, *http.Request) int { return 0 })
+	defer s.Close()
+	s.Authorization = "Bearer fresh"
+
+	g := gerrit.New(s.GerritURL())
+	auth := &staleAuth{token: "stale"}
+	g.Authenticator = auth
+
+	// A POST that is refused is sent again, with its body, after the
+	// credentials are refreshed.
+	in := &gerrit.CheckInput{CheckerUUID: "fmt:a", State: gerrit.StateRunning}
+	if _, err := g.PostCheckContext(ctx, "1", 1, in); err != nil {
+		t.Fatalf("PostCheck: %v", err)
+	}
+	if auth.invalidated != 1 {
+		t.Errorf("Invalidate called %d times, want 1", auth.invalidated)
+	}
+	if got := c.count(); got != 2 {
+		t.Errorf("got %d requests, want 2", got)
+	}
+	if got := s.Check(1, 1, "fmt:a"); got == nil || got.State != gerrit.StateRunning {
+		t.Errorf("PostCheck: got check %+v, want state RUNNING", got)
+	}
+
+	// Credentials that are refused after a refresh are not refreshed
+	// again.
+	s.Authorization = "Bearer other"
+	if _, err := g.GetPath("a/accounts/self"); gerrit.StatusCode(err) != http.StatusUnauthorized {
+		t.Errorf("GetPath: got %v, want status 401", err)
+	}
+	if auth.invalidated != 2 {
+		t.Errorf("Invalidate called %d times, want 2", auth.invalidated)
+	}
+	if got := c.count(); got != 4 {
+		t.Errorf("got %d requests, want 4", got)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 Google Ltd. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gerrit
+
+import "fmt"
+
+// CheckState is the state of a check in the checks plugin.
+//
+// A check starts out NOT_STARTED, and may be SCHEDULED by the
+// checker. It is RUNNING while the checker works on it, and ends as
+// SUCCESSFUL, FAILED or NOT_RELEVANT. A check only finishes after
+// running. Rerunning a check resets it to NOT_STARTED.
+type CheckState string
+
+const (
+	StateNotStarted  CheckState = "NOT_STARTED"
+	StateScheduled   CheckState = "SCHEDULED"
+	StateRunning     CheckState = "RUNNING"
+	StateSuccessful  CheckState = "SUCCESSFUL"
+	StateFailed      CheckState = "FAILED"
+	StateNotRelevant CheckState = "NOT_RELEVANT"
+)
+
+// transitions lists the states that each state may move to.
+var transitions = map[CheckState][]CheckState{
+	StateNotStarted:  {StateScheduled, StateRunning},
+	StateScheduled:   {StateNotStarted, StateRunning},
+	StateRunning:     {StateSuccessful, StateFailed, StateNotRelevant},
+	StateSuccessful:  {StateNotStarted},
+	StateFailed:      {StateNotStarted},
+	StateNotRelevant: {StateNotStarted},
+}
+
+// IsValid returns whether s is a known state.
+func (s CheckState) IsValid() bool {
+	_, ok := transitions[s]
+	return ok
+}
+
+// IsPending returns whether the check still has to run. The empty
+// state counts as NOT_STARTED.
+func (s CheckState) IsPending() bool {
+	return s == "" || s == StateNotStarted || s == StateScheduled
+}
+
+// IsTerminal returns whether the check has finished.
+func (s CheckState) IsTerminal() bool {
+	return s == StateSuccessful || s == StateFailed || s == StateNotRelevant
+}
+
+// CanTransition returns whether a check may move from s to next.
+// Staying in the same state is allowed, so updates can be retried.
+func (s CheckState) CanTransition(next CheckState) bool {
+	if s == "" {
+		s = StateNotStarted
+	}
+	if s == next {
+		return s.IsValid()
+	}
+	for _, t := range transitions[s] {
+		if t == next {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition returns next, or an error if a check may not move from s
+// to next.
+func (s CheckState) Transition(next CheckState) (CheckState, error) {
+	if !s.CanTransition(next) {
+		return s, fmt.Errorf("invalid check state transition %s -> %s", s, next)
+	}
+	return next, nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gerrit
+
+import "testing"
+
+func TestCheckStatePredicates(t *testing.T) {
+	for _, tc := range []struct {
+		state    CheckState
+		pending  bool
+		terminal bool
+		valid    bool
+	}{
+		{"", true, false, false},
+		{StateNotStarted, true, false, true},
+		{StateScheduled, true, false, true},
+		{StateRunning, false, false, true},
+		{StateSuccessful, false, true, true},
+		{StateFailed, false, true, true},
+		{StateNotRelevant, false, true, true},
+		{"BOGUS", false, false, false},
+	} {
+		if got := tc.state.IsPending(); got != tc.pending {
+			t.Errorf("%q.IsPending(): got %v, want %v", tc.state, got, tc.pending)
+		}
+		if got := tc.state.IsTerminal(); got != tc.terminal {
+			t.Errorf("%q.IsTerminal(): got %v, want %v", tc.state, got, tc.terminal)
+		}
+		if got := tc.state.IsValid(); got != tc.valid {
+			t.Errorf("%q.IsValid(): got %v, want %v", tc.state, got, tc.valid)
+		}
+	}
+}
+
+func TestCanTransition(t *testing.T) {
+	for _, tc := range []struct {
+		from, to CheckState
+		want     bool
+	}{
+		// The empty state is NOT_STARTED.
+		{"", StateNotStarted, true},
+		{"", StateScheduled, true},
+		{"", StateRunning, true},
+		{"", StateSuccessful, false},
+		{"", StateFailed, false},
+		{"", StateNotRelevant, false},
+		{"", "", false},
+
+		// Pending checks must run before they finish.
+		{StateNotStarted, StateScheduled, true},
+		{StateNotStarted, StateRunning, true},
+		{StateNotStarted, StateSuccessful, false},
+		{StateNotStarted, StateFailed, false},
+		{StateNotStarted, StateNotRelevant, false},
+		{StateScheduled, StateNotStarted, true},
+		{StateScheduled, StateRunning, true},
+		{StateScheduled, StateSuccessful, false},
+		{StateScheduled, StateFailed, false},
+		{StateScheduled, StateNotRelevant, false},
+
+		{StateRunning, StateSuccessful, true},
+		{StateRunning, StateFailed, true},
+		{StateRunning, StateNotRelevant, true},
+		{StateRunning, StateNotStarted, false},
+		{StateRunning, StateScheduled, false},
+
+		// Finished checks only go back to NOT_STARTED, on a rerun.
+		{StateSuccessful, StateNotStarted, true},
+		{StateSuccessful, StateRunning, false},
+		{StateSuccessful, StateFailed, false},
+		{StateFailed, StateNotStarted, true},
+		{StateFailed, StateSuccessful, false},
+		{StateNotRelevant, StateNotStarted, true},
+		{StateNotRelevant, StateScheduled, false},
+
+		// Updates may repeat the current state.
+		{StateNotStarted, StateNotStarted, true},
+		{StateRunning, StateRunning, true},
+		{StateFailed, StateFailed, true},
+
+		{StateRunning, "", false},
+		{StateRunning, "BOGUS", false},
+		{"BOGUS", "BOGUS", false},
+		{"BOGUS", StateRunning, false},
+	} {
+		if got := tc.from.CanTransition(tc.to); got != tc.want {
+			t.Errorf("%q.CanTransition(%q): got %v, want %v", tc.from, tc.to, got, tc.want)
+		}
+		_, err := tc.from.Transition(tc.to)
+		if got := err == nil; got != tc.want {
+			t.Errorf("%q.Transition(%q): got error %v, want ok %v", tc.from, tc.to, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2020 Google Ltd. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gerrit
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// TransportOptions configures the connections to a Gerrit host.
+type TransportOptions struct {
+	// CAFile is a PEM bundle of certificate authorities to trust, in
+	// addition to the system ones.
+	CAFile string
+
+	// CertFile and KeyFile are a PEM client certificate and key, for
+	// mutual TLS.
+	CertFile string
+	KeyFile  string
+
+	// Proxy is the URL of an HTTP proxy. If empty, the proxy is taken
+	// from the environment (HTTPS_PROXY, NO_PROXY, etc.).
+	Proxy string
+
+	// DialTimeout, TLSHandshakeTimeout and ResponseHeaderTimeout bound
+	// the phases of a request. Zero means the defaults of
+	// http.DefaultTransport, or no limit for ResponseHeaderTimeout.
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+
+	// ReloadInterval is how often the certificate files are checked
+	// for changes. Zero means once a minute.
+	ReloadInterval time.Duration
+}
+
+// defaultReloadInterval is the default TransportOptions.ReloadInterval.
+const defaultReloadInterval = time.Minute
+
+// Transport is an http.RoundTripper configured by TransportOptions. It
+// checks the certificate files every ReloadInterval, and starts using
+// new connections when they change, so certificates can be rotated.
+type Transport struct {
+	opts TransportOptions
+
+	mu      sync.Mutex
+	current *http.Transport
+	stamp   string
+
+	// checked is when the files were last checked.
+	checked time.Time
+}
+
+// NewTransport creates a Transport for Server.Client.
+func NewTransport(opts *TransportOptions) (*Transport, error) {
+	t := &Transport{opts: *opts}
+	stamp, err := t.filesStamp()
+	if err != nil {
+		return nil, err
+	}
+	t.current, err = t.build()
+	if err != nil {
+		return nil, err
+	}
+	t.stamp = stamp
+	t.checked = time.Now()
+	return t, nil
+}
+
+// filesStamp returns a string that changes when the certificate files
+// change.
+func (t *Transport) filesStamp() (string, error) {
+	stamp := ""
+	for _, name := range []string{t.opts.CAFile, t.opts.CertFile, t.opts.KeyFile} {
+		if name == "" {
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			return "", err
+		}
+		stamp += fmt.Sprintf("%s:%d:%d;", name, fi.ModTime().UnixNano(), fi.Size())
+	}
+	return stamp, nil
+}
+
+// build creates an http.Transport from the options and the current
+// certificate files.
+func (t *Transport) build() (*http.Transport, error) {
+	tlsConfig := &tls.Config{}
+	if t.opts.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", t.opts.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if t.opts.CertFile != "" || t.opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.opts.CertFile, t.opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if t.opts.Proxy != "" {
+		u, err := url.Parse(t.opts.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %v", err)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	dialTimeout := t.opts.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = 30 * time.Second
+	}
+	handshakeTimeout := t.opts.TLSHandshakeTimeout
+	if handshakeTimeout == 0 {
+		handshakeTimeout = 10 * time.Second
+	}
+
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   dialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   handshakeTimeout,
+		ResponseHeaderTimeout: t.opts.ResponseHeaderTimeout,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}, nil
+}
+
+// transport returns the http.Transport for the current certificate
+// files. If reloading fails, the previous one is kept.
+func (t *Transport) transport() *http.Transport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.opts.CAFile == "" && t.opts.CertFile == "" && t.opts.KeyFile == "" {
+		return t.current
+	}
+	interval := t.opts.ReloadInterval
+	if interval == 0 {
+		interval = defaultReloadInterval
+	}
+	now := time.Now()
+	if now.Sub(t.checked) < interval {
+		return t.current
+	}
+	t.checked = now
+
+	stamp, err := t.filesStamp()
+	if err != nil || stamp == t.stamp {
+		return t.current
+	}
+
+	// Files that are being written change again once complete, so
+	// don't retry a failed reload until then.
+	next, err := t.build()
+	if err != nil {
+		log.Printf("reloading certificates: %v", err)
+		t.stamp = stamp
+		return t.current
+	}
+	log.Printf("certificates changed, reloaded")
+	t.current.CloseIdleConnections()
+	t.current, t.stamp = next, stamp
+	return next
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.transport().RoundTrip(req)
+}
+
+// CloseIdleConnections closes the idle connections of the transport.
+func (t *Transport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.current.CloseIdleConnections()
+}
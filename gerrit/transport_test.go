@@ -0,0 +1,77 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gerrit
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTransportReload(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err := NewTransport(&TransportOptions{
+		CAFile:         caFile,
+		ReloadInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: tr}
+	rep, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep.Body.Close()
+
+	first := tr.transport()
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(caFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	// The change isn't seen before the interval passes.
+	if got := tr.transport(); got != first {
+		t.Errorf("transport reloaded before ReloadInterval")
+	}
+
+	tr.checked = tr.checked.Add(-time.Hour)
+	if got := tr.transport(); got == first {
+		t.Errorf("transport not reloaded after ReloadInterval")
+	}
+	rep, err = client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep.Body.Close()
+}
@@ -16,23 +16,144 @@ package gerrit
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 )
 
 var jsonPrefix = []byte(")]}'")
 
 type File struct {
-	Status        string
+	Status string
+
+	// OldPath is the path before a rename or copy.
+	OldPath string `json:"old_path"`
+	Binary  bool   `json:"binary"`
+
+	// OldMode and NewMode are the git file modes, eg. 0100644. They
+	// are 0 if the file doesn't exist on that side.
+	OldMode int `json:"old_mode"`
+	NewMode int `json:"new_mode"`
+
 	LinesInserted int `json:"lines_inserted"`
 	SizeDelta     int `json:"size_delta"`
 	Size          int
 	Content       []byte
 }
 
+// Git file modes.
+const (
+	ModeRegular    = 0100644
+	ModeExecutable = 0100755
+	ModeSymlink    = 0120000
+	ModeGitlink    = 0160000
+
+	modeTypeMask = 0170000
+)
+
+// FileType classifies a changed entry.
+type FileType int
+
+const (
+	FileRegular FileType = iota
+	FileExecutable
+	FileSymlink
+	FileGitlink
+	FileBinary
+)
+
+func (t FileType) String() string {
+	return map[FileType]string{
+		FileRegular:    "regular",
+		FileExecutable: "executable",
+		FileSymlink:    "symlink",
+		FileGitlink:    "gitlink",
+		FileBinary:     "binary",
+	}[t]
+}
+
+// modeType classifies a git file mode. Mode 0, which older Gerrit
+// versions report for all files, is taken to be a regular file.
+func modeType(mode int) FileType {
+	switch mode & modeTypeMask {
+	case ModeSymlink:
+		return FileSymlink
+	case ModeGitlink:
+		return FileGitlink
+	}
+	if mode&0111 != 0 {
+		return FileExecutable
+	}
+	return FileRegular
+}
+
+// Type returns the type of the file in the new revision.
+func (f *File) Type() FileType {
+	t := modeType(f.NewMode)
+	if f.Binary && (t == FileRegular || t == FileExecutable) {
+		return FileBinary
+	}
+	return t
+}
+
+// OldType returns the type of the file in the parent revision.
+func (f *File) OldType() FileType {
+	return modeType(f.OldMode)
+}
+
+// baseFetcher returns the content of a file in the parent revision.
+type baseFetcher func(ctx context.Context, name string) ([]byte, error)
+
 type Change struct {
 	Files map[string]*File
+
+	// Parent is the 1-based parent revision that Files is
+	// relative to. 0 means the default base.
+	Parent int
+
+	base baseFetcher
+
+	mu          sync.Mutex
+	baseContent map[string][]byte
+}
+
+// BaseContent returns the content of a file in the parent
+// revision. For renamed and copied files, this is the content of the
+// old path. Added files have no base content. Contents are fetched on
+// first use.
+func (c *Change) BaseContent(ctx context.Context, name string) ([]byte, error) {
+	f := c.Files[name]
+	if f == nil {
+		return nil, fmt.Errorf("file %q not in change", name)
+	}
+	if f.Status == "A" || c.base == nil {
+		return nil, nil
+	}
+	if f.OldPath != "" {
+		name = f.OldPath
+	}
+
+	c.mu.Lock()
+	content, ok := c.baseContent[name]
+	c.mu.Unlock()
+	if ok {
+		return content, nil
+	}
+
+	content, err := c.base(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.baseContent == nil {
+		c.baseContent = map[string][]byte{}
+	}
+	c.baseContent[name] = content
+	return content, nil
 }
 
 type CheckerInput struct {
@@ -111,7 +232,7 @@ func Unmarshal(content []byte, dest interface{}) error {
 }
 
 type PendingCheckInfo struct {
-	State string
+	State CheckState
 }
 
 type CheckablePatchSetInfo struct {
@@ -137,10 +258,11 @@ func (info *PendingCheckInfo) String() string {
 
 type CheckInput struct {
 	CheckerUUID string     `json:"checker_uuid"`
-	State       string     `json:"state"`
+	State       CheckState `json:"state"`
 	Message     string     `json:"message"`
 	URL         string     `json:"url"`
 	Started     *Timestamp `json:"started"`
+	Finished    *Timestamp `json:"finished"`
 }
 
 func (in *CheckInput) String() string {
@@ -149,17 +271,180 @@ func (in *CheckInput) String() string {
 }
 
 type CheckInfo struct {
-	Repository    string    `json:"repository"`
-	ChangeNumber  int       `json:"change_number"`
-	PatchSetID    int       `json:"patch_set_id"`
-	CheckerUUID   string    `json:"checker_uuid"`
-	State         string    `json:"state"`
-	Message       string    `json:"message"`
-	Started       Timestamp `json:"started"`
-	Finished      Timestamp `json:"finished"`
-	Created       Timestamp `json:"created"`
-	Updated       Timestamp `json:"updated"`
-	CheckerName   string    `json:"checker_name"`
-	CheckerStatus string    `json:"checker_status"`
-	Blocking      []string  `json:"blocking"`
+	Repository    string     `json:"repository"`
+	ChangeNumber  int        `json:"change_number"`
+	PatchSetID    int        `json:"patch_set_id"`
+	CheckerUUID   string     `json:"checker_uuid"`
+	State         CheckState `json:"state"`
+	Message       string     `json:"message"`
+	Started       Timestamp  `json:"started"`
+	Finished      Timestamp  `json:"finished"`
+	Created       Timestamp  `json:"created"`
+	Updated       Timestamp  `json:"updated"`
+	CheckerName   string     `json:"checker_name"`
+	CheckerStatus string     `json:"checker_status"`
+	Blocking      []string   `json:"blocking"`
+}
+
+type AccountInfo struct {
+	AccountID int    `json:"_account_id"`
+	Name      string `json:"name"`
+	Email     string `json:"email"`
+	Username  string `json:"username"`
+}
+
+type GitPersonInfo struct {
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	Date  Timestamp `json:"date"`
+	TZ    int       `json:"tz"`
+}
+
+type CommitInfo struct {
+	Commit    string         `json:"commit"`
+	Parents   []*CommitInfo  `json:"parents"`
+	Author    *GitPersonInfo `json:"author"`
+	Committer *GitPersonInfo `json:"committer"`
+	Subject   string         `json:"subject"`
+	Message   string         `json:"message"`
+}
+
+type RevisionInfo struct {
+	Kind     string       `json:"kind"`
+	Number   int          `json:"_number"`
+	Created  Timestamp    `json:"created"`
+	Uploader *AccountInfo `json:"uploader"`
+	Ref      string       `json:"ref"`
+	Commit   *CommitInfo  `json:"commit"`
+
+	// Files is only filled with the CURRENT_FILES or ALL_FILES
+	// options, and never has contents.
+	Files map[string]*File `json:"files"`
+}
+
+type ApprovalInfo struct {
+	AccountInfo
+	Value int       `json:"value"`
+	Date  Timestamp `json:"date"`
+}
+
+type LabelInfo struct {
+	Optional     bool              `json:"optional"`
+	Approved     *AccountInfo      `json:"approved"`
+	Rejected     *AccountInfo      `json:"rejected"`
+	Recommended  *AccountInfo      `json:"recommended"`
+	Disliked     *AccountInfo      `json:"disliked"`
+	Blocking     bool              `json:"blocking"`
+	Value        int               `json:"value"`
+	DefaultValue int               `json:"default_value"`
+	All          []*ApprovalInfo   `json:"all"`
+	Values       map[string]string `json:"values"`
+}
+
+type ChangeInfo struct {
+	ID              string                   `json:"id"`
+	Project         string                   `json:"project"`
+	Branch          string                   `json:"branch"`
+	Topic           string                   `json:"topic"`
+	Hashtags        []string                 `json:"hashtags"`
+	ChangeID        string                   `json:"change_id"`
+	Subject         string                   `json:"subject"`
+	Status          string                   `json:"status"`
+	Created         Timestamp                `json:"created"`
+	Updated         Timestamp                `json:"updated"`
+	Submitted       *Timestamp               `json:"submitted"`
+	Insertions      int                      `json:"insertions"`
+	Deletions       int                      `json:"deletions"`
+	Number          int                      `json:"_number"`
+	Owner           *AccountInfo             `json:"owner"`
+	Labels          map[string]*LabelInfo    `json:"labels"`
+	CurrentRevision string                   `json:"current_revision"`
+	Revisions       map[string]*RevisionInfo `json:"revisions"`
+	WorkInProgress  bool                     `json:"work_in_progress"`
+	IsPrivate       bool                     `json:"is_private"`
+
+	// MoreChanges is set on the last change of a query result
+	// page if there are more results.
+	MoreChanges bool `json:"_more_changes"`
+}
+
+func (info *ChangeInfo) String() string {
+	out, _ := json.Marshal(info)
+	return string(out)
+}
+
+// CurrentRevisionInfo returns the current revision, if it was
+// requested with the CURRENT_REVISION or ALL_REVISIONS options.
+func (info *ChangeInfo) CurrentRevisionInfo() *RevisionInfo {
+	return info.Revisions[info.CurrentRevision]
+}
+
+type CommentRange struct {
+	StartLine      int `json:"start_line"`
+	StartCharacter int `json:"start_character"`
+	EndLine        int `json:"end_line"`
+	EndCharacter   int `json:"end_character"`
+}
+
+type CommentInput struct {
+	// Path is implied by the key in ReviewInput maps.
+	Path string `json:"path,omitempty"`
+
+	// Side is "REVISION" (default) or "PARENT".
+	Side string `json:"side,omitempty"`
+
+	// Line is 0 for a file comment.
+	Line       int           `json:"line,omitempty"`
+	Range      *CommentRange `json:"range,omitempty"`
+	InReplyTo  string        `json:"in_reply_to,omitempty"`
+	Message    string        `json:"message"`
+	Unresolved *bool         `json:"unresolved,omitempty"`
+}
+
+type FixReplacementInfo struct {
+	Path        string        `json:"path"`
+	Range       *CommentRange `json:"range"`
+	Replacement string        `json:"replacement"`
+}
+
+type FixSuggestionInfo struct {
+	FixID        string                `json:"fix_id,omitempty"`
+	Description  string                `json:"description"`
+	Replacements []*FixReplacementInfo `json:"replacements"`
+}
+
+type RobotCommentInput struct {
+	CommentInput
+	RobotID        string               `json:"robot_id"`
+	RobotRunID     string               `json:"robot_run_id"`
+	URL            string               `json:"url,omitempty"`
+	Properties     map[string]string    `json:"properties,omitempty"`
+	FixSuggestions []*FixSuggestionInfo `json:"fix_suggestions,omitempty"`
+}
+
+type ReviewInput struct {
+	Message string `json:"message,omitempty"`
+	Tag     string `json:"tag,omitempty"`
+
+	// Labels maps label names, eg. "Code-Style", to votes.
+	Labels map[string]int `json:"labels,omitempty"`
+
+	// Comments and RobotComments are keyed by file path.
+	Comments      map[string][]*CommentInput      `json:"comments,omitempty"`
+	RobotComments map[string][]*RobotCommentInput `json:"robot_comments,omitempty"`
+
+	OmitDuplicateComments bool `json:"omit_duplicate_comments,omitempty"`
+
+	// Notify is one of NONE, OWNER, OWNER_REVIEWERS or ALL.
+	Notify string `json:"notify,omitempty"`
+}
+
+func (in *ReviewInput) String() string {
+	out, _ := json.Marshal(in)
+	return string(out)
+}
+
+type ReviewResult struct {
+	Labels map[string]int `json:"labels"`
+	Ready  bool           `json:"ready"`
 }
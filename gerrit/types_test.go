@@ -0,0 +1,61 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gerrit
+
+import (
+	"context"
+	"testing"
+)
+
+func TestChangeBaseContent(t *testing.T) {
+	var fetched []string
+	c := &Change{
+		Files: map[string]*File{
+			"added.go":   {Status: "A"},
+			"changed.go": {Status: "M"},
+			"new.go":     {Status: "R", OldPath: "old.go"},
+		},
+		base: func(ctx context.Context, name string) ([]byte, error) {
+			fetched = append(fetched, name)
+			return []byte("base " + name), nil
+		},
+	}
+
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name string
+		want string
+	}{
+		{"added.go", ""},
+		{"changed.go", "base changed.go"},
+		{"new.go", "base old.go"},
+		{"changed.go", "base changed.go"},
+	} {
+		got, err := c.BaseContent(ctx, tc.name)
+		if err != nil {
+			t.Fatalf("BaseContent(%q): %v", tc.name, err)
+		}
+		if string(got) != tc.want {
+			t.Errorf("BaseContent(%q): got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+	if want := []string{"changed.go", "old.go"}; len(fetched) != len(want) || fetched[0] != want[0] || fetched[1] != want[1] {
+		t.Errorf("fetched %q, want %q once each", fetched, want)
+	}
+
+	if _, err := c.BaseContent(ctx, "missing.go"); err == nil {
+		t.Errorf("BaseContent(missing.go): got nil error")
+	}
+}